@@ -0,0 +1,40 @@
+// Command containers-storage-registry is the distribution registry with the
+// containerstorage storage driver built in, so that the images in the host's
+// container store can be served without building a registry of your own.
+//
+// It is used in the same way as the upstream registry binary:
+//
+//	containers-storage-registry serve /etc/containers-storage-registry/config.yml
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/distribution/distribution/v3/registry"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	_ "github.com/distribution/distribution/v3/registry/auth/silly"
+	_ "github.com/distribution/distribution/v3/registry/auth/token"
+
+	"github.com/zaneb/distribution-containers-storage/pkg/driver"
+)
+
+func main() {
+	// The container store runs some operations in a re-executed copy of
+	// the program
+	if reexec.Init() {
+		return
+	}
+	driver.ReexecInUserNamespace()
+
+	registry.RootCmd.Use = "containers-storage-registry"
+	registry.RootCmd.Short = "Serve the local container store as a registry"
+	registry.RootCmd.Long = "Serve the images in the local container store as a registry."
+	registry.RootCmd.Execute()
+	// The registry returns once it has shut down gracefully on SIGTERM
+	if err := driver.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
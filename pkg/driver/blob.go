@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"slices"
 	"strings"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -18,46 +20,36 @@ func (bl *blobList) Reader() (io.ReadCloser, error) {
 }
 
 func (bl *blobList) Stat() (storagedriver.FileInfo, error) {
-	info := storagedriver.FileInfoInternal{
-		storagedriver.FileInfoFields{
-			Path:  bl.path(),
-			IsDir: true,
-		},
-	}
-
 	path := strings.Split(bl.subPath, "/")
 	if path[0] != "blobs" {
 		return nil, storagedriver.PathNotFoundError{Path: bl.path()}
 	}
 	if len(path) == 1 {
-		return info, nil
+		return bl.dirInfo("")
 	}
 
 	if path[1] != "sha256" {
 		return nil, storagedriver.PathNotFoundError{Path: bl.path()}
 	}
 	if len(path) == 2 {
-		return info, nil
+		return bl.dirInfo("")
 	}
-	blobs, err := bl.store.listBlobs()
+	if len(path[2]) != 2 || len(path) > 3 && !strings.HasPrefix(path[3], path[2]) {
+		return nil, storagedriver.PathNotFoundError{Path: bl.path()}
+	}
+	prefix := path[len(path)-1]
+	blobs, err := bl.store.listBlobs(bl.ctx, prefix)
 	if err != nil {
 		return nil, err
 	}
-	if len(path) == 3 {
-		for _, sha := range blobs {
-			if sha[:2] == path[2] {
-				return info, nil
-			}
+	switch len(path) {
+	case 3:
+		if len(blobs) > 0 {
+			return bl.dirInfo("")
 		}
-	}
-	if path[3][:2] != path[2] {
-		return nil, storagedriver.PathNotFoundError{Path: bl.path()}
-	}
-	if len(path) == 4 {
-		for _, sha := range blobs {
-			if sha == path[3] {
-				return info, nil
-			}
+	case 4:
+		if slices.Contains(blobs, prefix) {
+			return bl.blobInfo(prefix, true, 0)
 		}
 	}
 	return nil, storagedriver.PathNotFoundError{Path: bl.path()}
@@ -75,56 +67,82 @@ func (bl *blobList) List() ([]string, error) {
 	if path[1] != "sha256" {
 		return nil, storagedriver.PathNotFoundError{Path: bl.path()}
 	}
-	blobs, err := bl.store.listBlobs()
-	if err != nil {
-		return nil, err
-	}
 	if len(path) == 2 {
+		blobs, err := bl.store.listBlobs(bl.ctx, "")
+		if err != nil {
+			return nil, err
+		}
 		dirs := map[string]struct{}{}
 		for _, sha := range blobs {
 			dirs[sha[:2]] = struct{}{}
 		}
 		dirlist := make([]string, 0, len(dirs))
-		for k, _ := range dirs {
+		for k := range dirs {
 			dirlist = append(dirlist, k)
 		}
 		return bl.children(dirlist...), nil
 	}
-	if len(path) == 3 {
-		dirlist := []string{}
-		for _, sha := range blobs {
-			if sha[:2] == path[2] {
-				dirlist = append(dirlist, sha)
-			}
-		}
-		return bl.children(dirlist...), nil
-	}
-	if path[3][:2] != path[2] {
+	if len(path[2]) != 2 || len(path) > 3 && !strings.HasPrefix(path[3], path[2]) {
 		return nil, storagedriver.PathNotFoundError{Path: bl.path()}
 	}
-	if len(path) == 4 {
-		for _, sha := range blobs {
-			if sha == path[3] {
-				return bl.children("data"), nil
-			}
+	prefix := path[len(path)-1]
+	blobs, err := bl.store.listBlobs(bl.ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	switch len(path) {
+	case 3:
+		return bl.children(blobs...), nil
+	case 4:
+		if slices.Contains(blobs, prefix) {
+			return bl.children("data"), nil
 		}
 	}
 	return nil, storagedriver.PathNotFoundError{Path: bl.path()}
 }
 
+// delete removes a blob directory.
+func (bl *blobList) delete() error {
+	path := strings.Split(bl.subPath, "/")
+	if len(path) != 4 || path[1] != "sha256" || !strings.HasPrefix(path[3], path[2]) {
+		return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+	return bl.store.deleteBlob(bl.ctx, path[3])
+}
+
 type blob struct {
 	filePath
 }
 
-func (b *blob) getBlob() (blobFunc, int64, error) {
+// sha returns the digest of the blob from its path.
+func (b *blob) sha() (string, error) {
 	path := strings.Split(b.subPath, "/")
 	if len(path) != 5 ||
 		path[1] != "sha256" ||
+		len(path[3]) < 2 ||
 		path[3][:2] != path[2] ||
 		path[4] != "data" {
+		return "", storagedriver.PathNotFoundError{Path: b.path()}
+	}
+	return path[3], nil
+}
+
+func (b *blob) getBlob() (blobFunc, int64, error) {
+	sha, err := b.sha()
+	if err != nil {
+		return nil, 0, err
+	}
+	getBlobReader, size, err := b.store.getBlob(b.ctx, sha)
+	if errors.Is(err, errNotFound) {
 		return nil, 0, storagedriver.PathNotFoundError{Path: b.path()}
 	}
-	return b.store.getBlob(path[3])
+	if errors.As(err, &ErrUnreproducibleBlob{}) {
+		return nil, 0, storagedriver.Error{
+			DriverName: driverName,
+			Enclosed:   err,
+		}
+	}
+	return getBlobReader, size, err
 }
 
 func (b *blob) Reader() (io.ReadCloser, error) {
@@ -132,19 +150,45 @@ func (b *blob) Reader() (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	return getBlobReader()
+	r, err := getBlobReader()
+	if errors.Is(err, fs.ErrNotExist) {
+		// The blob was evicted from the cache before we could open it
+		getBlobReader, _, err = b.getBlob()
+		if err != nil {
+			return nil, err
+		}
+		r, err = getBlobReader()
+	}
+	return r, err
 }
 
 func (b *blob) Stat() (storagedriver.FileInfo, error) {
 	_, size, err := b.getBlob()
-	if err != nil {
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil, err
+	} else if err != nil {
 		return nil, fmt.Errorf("cannot stat blob: %w", err)
-		//return nil, err
+	}
+	sha, err := b.sha()
+	if err != nil {
+		return nil, err
+	}
+	return b.blobInfo(sha, false, size)
+}
+
+// blobInfo returns the FileInfo of a blob's data or directory, which was
+// modified when the blob was added to the store.
+func (fp *filePath) blobInfo(sha string, isDir bool, size int64) (storagedriver.FileInfo, error) {
+	modTime, err := fp.store.blobModTime(fp.ctx, sha)
+	if err != nil {
+		return nil, err
 	}
 	return storagedriver.FileInfoInternal{
-		storagedriver.FileInfoFields{
-			Path: b.path(),
-			Size: size,
+		FileInfoFields: storagedriver.FileInfoFields{
+			Path:    fp.path(),
+			IsDir:   isDir,
+			Size:    size,
+			ModTime: modTime,
 		},
 	}, nil
 }
@@ -0,0 +1,216 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var errDigestMismatch = errors.New("digest mismatch")
+
+// blobCache is a content-addressed on-disk cache of compressed layer blobs
+// that have been reproduced from the container store and verified against
+// their digest. Once the cache exceeds its maximum size, the least recently
+// used blobs are evicted.
+type blobCache struct {
+	dir     string
+	maxSize int64
+	// valid reports whether a cached blob is still backed by a layer in
+	// the container store.
+	valid func(digest.Digest) bool
+
+	evictLock sync.Mutex
+}
+
+func newBlobCache(dir string, maxSize int64, valid func(digest.Digest) bool) (*blobCache, error) {
+	// Discard any partially written blobs left behind by a previous run
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		return nil, fmt.Errorf("cannot clean blob cache: %w", err)
+	}
+	for _, d := range []string{"tmp", digest.Canonical.String()} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o700); err != nil {
+			return nil, fmt.Errorf("cannot create blob cache: %w", err)
+		}
+	}
+	return &blobCache{
+		dir:     dir,
+		maxSize: maxSize,
+		valid:   valid,
+	}, nil
+}
+
+func (c *blobCache) blobPath(d digest.Digest) string {
+	return filepath.Join(c.dir, d.Algorithm().String(), d.Encoded())
+}
+
+func (c *blobCache) blobFunc(path string) blobFunc {
+	return func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// get returns the cached blob with the given digest, if there is one.
+func (c *blobCache) get(d digest.Digest) (blobFunc, int64, bool) {
+	path := c.blobPath(d)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, false
+	}
+	if c.maxSize > 0 {
+		// The modification time records when the blob was last used,
+		// so that the least recently used blobs are evicted first.
+		// Otherwise it is left as the time the blob was added.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	return c.blobFunc(path), info.Size(), true
+}
+
+// modTime returns the time at which a cached blob was added or, in a cache
+// with a size limit, last used.
+func (c *blobCache) modTime(d digest.Digest) (time.Time, bool) {
+	info, err := os.Stat(c.blobPath(d))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// put stores the blob produced by getBlobReader in the cache if its content
+// matches the digest, and returns errDigestMismatch otherwise.
+func (c *blobCache) put(d digest.Digest, getBlobReader blobFunc) (blobFunc, int64, error) {
+	r, err := getBlobReader()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), d.Encoded())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	verifier := d.Verifier()
+	size, err := io.Copy(io.MultiWriter(tmp, verifier), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if !verifier.Verified() {
+		return nil, 0, errDigestMismatch
+	}
+
+	path := c.blobPath(d)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, 0, err
+	}
+	c.evict(path)
+	return c.blobFunc(path), size, nil
+}
+
+// insert moves the file at src into the cache if its content matches the
+// digest, and returns errDigestMismatch otherwise. The file must be on the
+// same filesystem as the cache.
+func (c *blobCache) insert(d digest.Digest, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	verifier := d.Verifier()
+	_, err = io.Copy(verifier, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return errDigestMismatch
+	}
+
+	path := c.blobPath(d)
+	if err := os.Rename(src, path); err != nil {
+		return err
+	}
+	c.evict(path)
+	return nil
+}
+
+// list returns the digests of all blobs in the cache.
+func (c *blobCache) list() ([]digest.Digest, error) {
+	entries, err := os.ReadDir(filepath.Join(c.dir, digest.Canonical.String()))
+	if err != nil {
+		return nil, err
+	}
+	digests := make([]digest.Digest, 0, len(entries))
+	for _, e := range entries {
+		digests = append(digests, digest.NewDigestFromEncoded(digest.Canonical, e.Name()))
+	}
+	return digests, nil
+}
+
+// remove deletes a blob from the cache.
+func (c *blobCache) remove(d digest.Digest) {
+	os.Remove(c.blobPath(d))
+}
+
+// evict removes blobs whose layers no longer exist, followed by the least
+// recently used blobs until the cache fits within its maximum size. The
+// blob at the path keep is never evicted.
+func (c *blobCache) evict(keep string) {
+	c.evictLock.Lock()
+	defer c.evictLock.Unlock()
+
+	dir := filepath.Join(c.dir, digest.Canonical.String())
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type cachedBlob struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	blobs := make([]cachedBlob, 0, len(entries))
+	var total int64
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		d := digest.NewDigestFromEncoded(digest.Canonical, e.Name())
+		if path != keep && c.valid != nil && !c.valid(d) {
+			os.Remove(path)
+			continue
+		}
+		blobs = append(blobs, cachedBlob{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	if c.maxSize <= 0 || total <= c.maxSize {
+		return
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].mtime.Before(blobs[j].mtime)
+	})
+	for _, b := range blobs {
+		if total <= c.maxSize {
+			break
+		}
+		if b.path == keep {
+			continue
+		}
+		if err := os.Remove(b.path); err == nil {
+			total -= b.size
+		}
+	}
+}
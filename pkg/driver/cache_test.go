@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bytesBlob(b []byte) blobFunc {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+func TestBlobCachePut(t *testing.T) {
+	c, err := newBlobCache(t.TempDir(), 0, nil)
+	require.NoError(t, err)
+
+	content := []byte("Hello, World!")
+	d := digest.FromBytes(content)
+	_, _, ok := c.get(d)
+	assert.False(t, ok)
+
+	_, _, err = c.put(d, bytesBlob([]byte("Goodbye, World!")))
+	assert.ErrorIs(t, err, errDigestMismatch)
+	_, _, ok = c.get(d)
+	assert.False(t, ok)
+
+	_, size, err := c.put(d, bytesBlob(content))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+
+	getBlobReader, size, ok := c.get(d)
+	require.True(t, ok)
+	assert.Equal(t, int64(len(content)), size)
+	r, err := getBlobReader()
+	require.NoError(t, err)
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, b)
+
+	c.remove(d)
+	_, _, ok = c.get(d)
+	assert.False(t, ok)
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	removed := map[digest.Digest]bool{}
+	c, err := newBlobCache(t.TempDir(), 20, func(d digest.Digest) bool {
+		return !removed[d]
+	})
+	require.NoError(t, err)
+
+	blobs := [][]byte{[]byte("first blob"), []byte("second blob"), []byte("third blob")}
+	digests := make([]digest.Digest, len(blobs))
+	for i, b := range blobs {
+		digests[i] = digest.FromBytes(b)
+	}
+
+	_, _, err = c.put(digests[0], bytesBlob(blobs[0]))
+	require.NoError(t, err)
+	// Ensure the first blob is the least recently used
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(c.blobPath(digests[0]), past, past))
+	_, _, err = c.put(digests[1], bytesBlob(blobs[1]))
+	require.NoError(t, err)
+
+	_, _, ok := c.get(digests[0])
+	assert.False(t, ok, "least recently used blob should be evicted")
+	_, _, ok = c.get(digests[1])
+	assert.True(t, ok)
+
+	removed[digests[1]] = true
+	_, _, err = c.put(digests[2], bytesBlob(blobs[2]))
+	require.NoError(t, err)
+	_, _, ok = c.get(digests[1])
+	assert.False(t, ok, "blob for removed layer should be evicted")
+	_, _, ok = c.get(digests[2])
+	assert.True(t, ok)
+}
+
+func TestBlobCacheModTime(t *testing.T) {
+	content := []byte("Hello, World!")
+	d := digest.FromBytes(content)
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, tc := range []struct {
+		maxSize int64
+		touched bool
+	}{
+		{0, false},
+		{100, true},
+	} {
+		c, err := newBlobCache(t.TempDir(), tc.maxSize, nil)
+		require.NoError(t, err)
+		_, _, err = c.put(d, bytesBlob(content))
+		require.NoError(t, err)
+		require.NoError(t, os.Chtimes(c.blobPath(d), past, past))
+
+		_, _, ok := c.get(d)
+		require.True(t, ok)
+		modTime, ok := c.modTime(d)
+		require.True(t, ok)
+		assert.Equal(t, tc.touched, modTime.After(past), "maxSize %d", tc.maxSize)
+	}
+}
@@ -0,0 +1,453 @@
+package driver
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/containers/storage/pkg/archive"
+	chunkedcompressor "github.com/containers/storage/pkg/chunked/compressor"
+	"github.com/docker/go-metrics"
+	kgzip "github.com/klauspost/compress/gzip"
+)
+
+// Compressor reproduces a compressed layer blob from an uncompressed layer
+// diff. Because a layer blob's digest covers its compressed form, a blob can
+// be served only if some Compressor produces exactly the same bytes as the
+// tool that originally built the layer.
+type Compressor interface {
+	// Name identifies the compressor in the configuration.
+	Name() string
+	// Format is the compression format produced by the compressor. Only
+	// compressors producing the same format as a layer was recorded with
+	// are tried for that layer.
+	Format() archive.Compression
+	// NewWriter returns a WriteCloser that compresses the data written to
+	// it into w. All of the compressed data must be flushed to w by the
+	// time Close returns.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// errCompressorUnavailable is returned by a Compressor that cannot be used on
+// this host.
+var errCompressorUnavailable = errors.New("compressor unavailable")
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[string]Compressor{}
+)
+
+// defaultCompressors are the compressors tried, in order, when none are
+// configured.
+var defaultCompressors = []string{
+	"pgzip",
+	"gzip",
+	"gzip-1",
+	"gzip-9",
+	"gzip-unix",
+	"klauspost-gzip",
+	"zstd",
+	"zstd-chunked",
+}
+
+// RegisterCompressor makes a Compressor available for use in the
+// "compressors" configuration option.
+func RegisterCompressor(c Compressor) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	if _, exists := compressors[c.Name()]; exists {
+		panic(fmt.Sprintf("compressor %q is already registered", c.Name()))
+	}
+	compressors[c.Name()] = c
+}
+
+func getCompressors(names []string) ([]Compressor, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	list := make([]Compressor, 0, len(names))
+	for _, n := range names {
+		c, ok := compressors[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown compressor %q", n)
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+func init() {
+	RegisterCompressor(archiveCompressor{"pgzip", archive.Gzip})
+	for _, impl := range []gzipImpl{stdlibGzip, klauspostGzip} {
+		def := gzipCompressor{impl: impl, level: gzip.DefaultCompression, header: gzip.Header{OS: 255}}
+		RegisterCompressor(def)
+		for level := gzip.BestSpeed; level <= gzip.BestCompression; level++ {
+			gc := gzipCompressor{impl: impl, level: level, header: gzip.Header{OS: 255}}
+			if level == impl.defaultLevel() {
+				gc.alias = def.Name()
+			}
+			RegisterCompressor(gc)
+		}
+	}
+	// GNU gzip records the OS as Unix in the header
+	RegisterCompressor(gzipCompressor{impl: stdlibGzip, level: gzip.DefaultCompression, header: gzip.Header{OS: 3}, suffix: "unix"})
+	RegisterCompressor(pigzCompressor{})
+	RegisterCompressor(archiveCompressor{"zstd", archive.Zstd})
+	RegisterCompressor(zstdChunkedCompressor{})
+}
+
+// compressorAlias is implemented by compressors that may produce exactly the
+// same output as another compressor registered under a different name.
+type compressorAlias interface {
+	// aliasOf returns the name of the other compressor, if any.
+	aliasOf() string
+}
+
+// canonicalName returns the name of the compressor that a compressor is an
+// alias of, or otherwise its own name.
+func canonicalName(c Compressor) string {
+	if a, ok := c.(compressorAlias); ok && a.aliasOf() != "" {
+		return a.aliasOf()
+	}
+	return c.Name()
+}
+
+// nondeterministicCompressor is implemented by compressors whose output may
+// differ between runs for the same input.
+type nondeterministicCompressor interface {
+	nondeterministic() bool
+}
+
+// isDeterministic returns whether a compressor always produces the same
+// output for the same input, so that a mismatch need not be retried.
+func isDeterministic(c Compressor) bool {
+	nc, ok := c.(nondeterministicCompressor)
+	return !ok || !nc.nondeterministic()
+}
+
+// archiveCompressor compresses using containers/storage, as it does when
+// producing a diff of a layer.
+type archiveCompressor struct {
+	name        string
+	compression archive.Compression
+}
+
+func (ac archiveCompressor) Name() string {
+	return ac.name
+}
+
+func (ac archiveCompressor) Format() archive.Compression {
+	return ac.compression
+}
+
+func (ac archiveCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return archive.CompressStream(w, ac.compression)
+}
+
+type gzipImpl string
+
+const (
+	stdlibGzip    gzipImpl = "gzip"
+	klauspostGzip gzipImpl = "klauspost-gzip"
+)
+
+// defaultLevel returns the compression level that the library uses for
+// gzip.DefaultCompression.
+func (impl gzipImpl) defaultLevel() int {
+	if impl == klauspostGzip {
+		return 5
+	}
+	return 6
+}
+
+// gzipCompressor compresses using either the stdlib gzip library (as used by
+// e.g. moby) or the klauspost/compress gzip library, with a given compression
+// level and header.
+type gzipCompressor struct {
+	impl   gzipImpl
+	level  int
+	header gzip.Header
+	suffix string
+	// name overrides the name derived from the other fields.
+	name string
+	// alias is the name of the compressor using the library's default
+	// level, if that is this compressor's level.
+	alias string
+}
+
+// NewGzipCompressor returns a Compressor that compresses using the stdlib gzip
+// library at the given level, writing the given header. This reproduces
+// blobs compressed by tools that record a file name or modification time in
+// the gzip header, such as GNU gzip when compressing a file, provided that
+// the values they recorded are known. The OS byte must be set as the tool
+// records it: 3 for Unix, or 255 if unknown.
+func NewGzipCompressor(name string, level int, header gzip.Header) Compressor {
+	return gzipCompressor{impl: stdlibGzip, level: level, header: header, name: name}
+}
+
+func (gc gzipCompressor) Name() string {
+	if gc.name != "" {
+		return gc.name
+	}
+	name := string(gc.impl)
+	if gc.level != gzip.DefaultCompression {
+		name += "-" + strconv.Itoa(gc.level)
+	}
+	if gc.suffix != "" {
+		name += "-" + gc.suffix
+	}
+	return name
+}
+
+func (gc gzipCompressor) Format() archive.Compression {
+	return archive.Gzip
+}
+
+func (gc gzipCompressor) aliasOf() string {
+	return gc.alias
+}
+
+func (gc gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch gc.impl {
+	case klauspostGzip:
+		zw, err := kgzip.NewWriterLevel(w, gc.level)
+		if err != nil {
+			return nil, err
+		}
+		zw.Header = kgzip.Header{
+			Comment: gc.header.Comment,
+			Extra:   gc.header.Extra,
+			ModTime: gc.header.ModTime,
+			Name:    gc.header.Name,
+			OS:      gc.header.OS,
+		}
+		return zw, nil
+	default:
+		zw, err := gzip.NewWriterLevel(w, gc.level)
+		if err != nil {
+			return nil, err
+		}
+		zw.Header = gc.header
+		return zw, nil
+	}
+}
+
+// pigzCompressor compresses using the pigz executable, if it is installed.
+type pigzCompressor struct{}
+
+func (pigzCompressor) Name() string {
+	return "pigz"
+}
+
+func (pigzCompressor) Format() archive.Compression {
+	return archive.Gzip
+}
+
+func (pigzCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	path, err := exec.LookPath("pigz")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCompressorUnavailable, err)
+	}
+	cmd := exec.Command(path, "--stdout", "--no-name")
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdWriter{WriteCloser: stdin, cmd: cmd}, nil
+}
+
+// zstdChunkedCompressor compresses in the zstd:chunked format, in which each
+// file is compressed in a separate zstd frame and the table of contents
+// needed for partial pulls is appended in skippable frames.
+//
+// The containers/storage compressor reads the tarball in two goroutines, and
+// the order in which they finish varies, so its output is not always the
+// same for the same input. A blob that it fails to reproduce is therefore
+// not remembered as unreproducible, and is tried again on later requests.
+// The table of contents is rebuilt from the tarball rather than taken from
+// the one that containers/storage keeps for the layer, and the annotations
+// that locate it are left out, since they are recorded in the image manifest
+// rather than in the blob.
+type zstdChunkedCompressor struct{}
+
+func (zstdChunkedCompressor) Name() string {
+	return "zstd-chunked"
+}
+
+func (zstdChunkedCompressor) Format() archive.Compression {
+	return archive.Zstd
+}
+
+func (zstdChunkedCompressor) nondeterministic() bool {
+	return true
+}
+
+func (zstdChunkedCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return chunkedcompressor.ZstdCompressor(w, map[string]string{}, nil)
+}
+
+// cmdWriter writes to the standard input of a command, and waits for the
+// command to exit when closed.
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (cw *cmdWriter) Close() error {
+	if err := cw.WriteCloser.Close(); err != nil {
+		cw.cmd.Wait()
+		return err
+	}
+	return cw.cmd.Wait()
+}
+
+// compressedBlob returns a function that compresses the blob returned by
+// getBlobReader using the given compressor.
+func compressedBlob(ctx context.Context, c Compressor, getBlobReader blobFunc) blobFunc {
+	return func() (io.ReadCloser, error) {
+		dr, err := getBlobReader()
+		if err != nil {
+			return nil, err
+		}
+
+		r, w := io.Pipe()
+		zw, err := c.NewWriter(meteredWriter{w, compressedBytes.WithValues(c.Name())})
+		if err != nil {
+			dr.Close()
+			return nil, err
+		}
+		_, span := startSpan(ctx, "compress", attrStrategy.String(c.Name()))
+		go func() {
+			var err error
+			defer endSpan(span, &err)
+			defer dr.Close()
+			defer metrics.StartTimer(compressionTimer.WithValues(c.Name()))()
+			_, err = io.Copy(zw, dr)
+			if closeErr := zw.Close(); err == nil {
+				err = closeErr
+			}
+			// Fail the transfer rather than ending the blob early
+			w.CloseWithError(err)
+		}()
+		return r, nil
+	}
+}
+
+// compressorMemo records which compressor reproduced each blob, so that
+// later requests for the same blob need not try the others.
+type compressorMemo struct {
+	lock        sync.Mutex
+	compressors map[string]Compressor
+}
+
+func newCompressorMemo() *compressorMemo {
+	return &compressorMemo{compressors: map[string]Compressor{}}
+}
+
+// candidates returns the compressors to try for the blob with the given
+// digest, in order.
+func (m *compressorMemo) candidates(sha string, all []Compressor) []Compressor {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c, ok := m.compressors[sha]
+	if !ok {
+		return all
+	}
+	if c == nil {
+		// Already known to be unreproducible
+		return nil
+	}
+	return []Compressor{c}
+}
+
+// set records the compressor that reproduced a blob, or nil if none did.
+func (m *compressorMemo) set(sha string, c Compressor) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.compressors[sha] = c
+}
+
+// prune forgets the blobs for which exists returns false.
+func (m *compressorMemo) prune(exists func(sha string) bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for sha := range m.compressors {
+		if !exists(sha) {
+			delete(m.compressors, sha)
+		}
+	}
+}
+
+// digestLocks holds a mutex for each digest that is in use.
+type digestLocks struct {
+	lock  sync.Mutex
+	locks map[string]*digestLock
+}
+
+type digestLock struct {
+	sync.Mutex
+	users int
+}
+
+func newDigestLocks() *digestLocks {
+	return &digestLocks{locks: map[string]*digestLock{}}
+}
+
+// acquire locks the mutex for a digest, and returns a function that
+// unlocks it.
+func (dl *digestLocks) acquire(sha string) func() {
+	dl.lock.Lock()
+	l, ok := dl.locks[sha]
+	if !ok {
+		l = &digestLock{}
+		dl.locks[sha] = l
+	}
+	l.users++
+	dl.lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		dl.lock.Lock()
+		defer dl.lock.Unlock()
+		l.users--
+		if l.users == 0 {
+			delete(dl.locks, sha)
+		}
+	}
+}
+
+// compressorsFor returns the compressors producing the given format, in
+// order. If the format is unknown, all compressors are returned. Only the
+// first of a compressor and its aliases is returned, since the others would
+// produce the same output. Compressors whose names are listed in preferred
+// are moved to the front.
+func compressorsFor(all []Compressor, format archive.Compression, preferred ...string) []Compressor {
+	matching := make([]Compressor, 0, len(all))
+	seen := map[string]struct{}{}
+	for _, c := range all {
+		if (format == archive.Gzip || format == archive.Zstd) && c.Format() != format {
+			continue
+		}
+		if _, ok := seen[canonicalName(c)]; ok {
+			continue
+		}
+		seen[canonicalName(c)] = struct{}{}
+		matching = append(matching, c)
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return slices.Contains(preferred, matching[i].Name()) &&
+			!slices.Contains(preferred, matching[j].Name())
+	})
+	return matching
+}
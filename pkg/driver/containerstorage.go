@@ -2,234 +2,757 @@ package driver
 
 import (
 	"bytes"
-	"compress/gzip"
-	"crypto/sha256"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/archive"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type blobFunc func() (io.ReadCloser, error)
 
+// errNotFound is returned when a blob, tag or manifest is not in the store.
+var errNotFound = errors.New("not found")
+
+// bytesReadCloser is a seekable ReadCloser for a blob held in memory.
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
+func bytesBlobFunc(b []byte) blobFunc {
+	return func() (io.ReadCloser, error) {
+		return bytesReadCloser{bytes.NewReader(b)}, nil
+	}
+}
+
 type store interface {
-	listRepos() ([]string, error)
-	listRepoRevisions(string) ([]string, error)
-	listRepoLayers(string) ([]string, error)
-	listBlobs() ([]string, error)
-	getBlob(sha string) (blobFunc, int64, error)
+	listRepos(ctx context.Context) ([]string, error)
+	listRepoRevisions(ctx context.Context, repo string) ([]string, error)
+	listRepoLayers(ctx context.Context, repo string) ([]string, error)
+	listRepoTags(ctx context.Context, repo string) (map[string]string, error)
+	listBlobs(ctx context.Context, prefix string) ([]string, error)
+	getBlob(ctx context.Context, sha string) (blobFunc, int64, error)
+	// repoModTime returns the time at which a repository, or if repo is
+	// empty the whole store, was last modified.
+	repoModTime(ctx context.Context, repo string) (time.Time, error)
+	// blobModTime returns the time at which a blob was added to the store.
+	blobModTime(ctx context.Context, sha string) (time.Time, error)
+
+	uploadPath(repo, subPath string) (string, error)
+	putBlob(ctx context.Context, sha string, content io.Reader) error
+	moveUpload(ctx context.Context, repo, subPath, sha string) error
+	linkLayer(ctx context.Context, repo, sha string) error
+	putManifest(ctx context.Context, repo, sha string) error
+	putTag(ctx context.Context, repo, tag, sha string) error
+
+	deleteTag(ctx context.Context, repo, tag string) error
+	deleteManifest(ctx context.Context, repo, sha string) error
+	deleteLayerLink(ctx context.Context, repo, sha string) error
+	deleteBlob(ctx context.Context, sha string) error
+
+	// close stops any background work, shuts down the container store
+	// and removes temporary files.
+	close() error
 }
 
-func newContainerStorage() (store, error) {
-	opts, err := storage.DefaultStoreOptionsAutoDetectUID()
+// sharedCaches holds the caches and limits shared by the stores of a union.
+type sharedCaches struct {
+	// union is the union that the stores belong to.
+	union *unionStore
+	// staged holds the blobs pushed to any of the stores.
+	staged *blobCache
+	// spool holds the reproduced blobs of stores without a cache
+	// directory.
+	spool *blobCache
+	// compressions limits the blobs reproduced at once by all of the
+	// stores.
+	compressions chan struct{}
+}
+
+// newContainerStorage opens the container store selected by params and
+// starts watching it.
+func newContainerStorage(params *driverParameters) (*containerStorage, error) {
+	cs, err := openContainerStorage(params, nil)
+	if err != nil {
+		return nil, err
+	}
+	cs.start(params)
+	return cs, nil
+}
+
+// openContainerStorage opens the container store selected by params without
+// starting any background work. Blobs pushed to the registry are staged, and
+// reproduced blobs spooled when there is no cache directory, in the shared
+// caches if given or otherwise in directories of the store's own.
+func openContainerStorage(params *driverParameters, shared *sharedCaches) (*containerStorage, error) {
+	opts, err := params.storeOptions()
 	if err != nil {
 		return nil, err
 	}
-	// This doesn't seem to help at all
-	opts.GraphDriverOptions = append(opts.GraphDriverOptions,
-		"overlay.ignore_chown_errors=true")
 	store, err := storage.GetStore(opts)
 	if err != nil {
 		return nil, err
 	}
-	return &containerStorage{
-		store: store,
-	}, nil
+	compressors, err := getCompressors(params.compressors)
+	if err != nil {
+		return nil, err
+	}
+	cs := &containerStorage{
+		store:          store,
+		hostPrefix:     params.hostPrefix,
+		compressors:    compressors,
+		memo:           newCompressorMemo(),
+		synthesize:     params.synthesizeManifests,
+		synthesized:    newSynthesisChecks(),
+		synthesisQueue: make(chan string, synthesisQueueSize),
+		compressions:   make(chan struct{}, params.maxCompressions),
+		reproducing:    newDigestLocks(),
+		done:           make(chan struct{}),
+	}
+	if shared != nil {
+		cs.union = shared.union
+		if shared.compressions != nil {
+			cs.compressions = shared.compressions
+		}
+	}
+	storeDir := opts.ImageStore
+	if storeDir == "" {
+		storeDir = store.GraphRoot()
+	}
+	if err := cs.openCaches(params, storeDir, additionalImageStores(opts), shared); err != nil {
+		cs.close()
+		return nil, err
+	}
+	return cs, nil
 }
 
-type containerStorage struct {
-	store storage.Store
+// start starts the background work of checking the container store for
+// changes, purging abandoned uploads and synthesizing manifests.
+func (cs *containerStorage) start(params *driverParameters) {
+	if params.watchInterval > 0 {
+		cs.watching.Add(1)
+		go cs.watch(params.watchInterval)
+	}
+	cs.watching.Add(1)
+	go cs.purge(purgeInterval)
+	if cs.synthesize {
+		cs.watching.Add(1)
+		go cs.synthesizeQueued()
+	}
 }
 
-func (cs *containerStorage) listRepos() ([]string, error) {
-	images, err := cs.store.Images()
+// openCaches opens the index cache and the directories in which blobs are
+// kept.
+func (cs *containerStorage) openCaches(params *driverParameters, storeDir string, imageStores []string, shared *sharedCaches) error {
+	var err error
+	cs.indexCache, err = newStoreIndexCache(storeDir, cs.store.GraphDriverName(), imageStores)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	names := map[string]struct{}{}
-	for _, i := range images {
-		for _, n := range i.Names {
-			names[n] = struct{}{}
+	switch {
+	case params.cacheDir != "":
+		cs.cache, err = newBlobCache(params.cacheDir, params.cacheSize, cs.hasLayer)
+	case shared != nil && shared.spool != nil:
+		cs.cache = shared.spool
+	default:
+		cs.cache, err = newSpool(params.cacheSize, cs.hasLayer)
+		if cs.cache != nil {
+			cs.tempDirs = append(cs.tempDirs, cs.cache.dir)
 		}
 	}
-	repos := make([]string, 0, len(names))
-	for n, _ := range names {
+	if err != nil {
+		return err
+	}
+	cs.uploadDir = params.uploadDir
+	if cs.uploadDir == "" {
+		cs.uploadDir, err = os.MkdirTemp("", "containerstorage-uploads-")
+		if err != nil {
+			return err
+		}
+		cs.tempDirs = append(cs.tempDirs, cs.uploadDir)
+	}
+	if shared != nil {
+		cs.staged = shared.staged
+	}
+	if cs.staged == nil {
+		cs.staged, err = newBlobCache(filepath.Join(cs.uploadDir, "blobs"), 0, nil)
+		if err != nil {
+			return err
+		}
+	}
+	// Pushed layer blobs are kept separately from reproduced ones, since
+	// they cannot be reproduced again if they are evicted.
+	pushedDir := filepath.Join(cs.uploadDir, "pushed")
+	if params.cacheDir != "" {
+		pushedDir = filepath.Join(params.cacheDir, "pushed")
+	}
+	cs.pushed, err = newBlobCache(pushedDir, 0, cs.hasLayer)
+	return err
+}
+
+// newSpool creates a temporary directory in which to keep reproduced blobs
+// when there is no cache, so that reads at an offset, and the read that
+// follows a stat, need not compress them again.
+func newSpool(size int64, valid func(digest.Digest) bool) (*blobCache, error) {
+	dir, err := os.MkdirTemp("", "containerstorage-spool-")
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		size = defaultSpoolSize
+	}
+	spool, err := newBlobCache(dir, size, valid)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return spool, nil
+}
+
+type containerStorage struct {
+	store       storage.Store
+	hostPrefix  hostPrefixMode
+	cache       *blobCache
+	compressors []Compressor
+	memo        *compressorMemo
+	uploadDir   string
+	staged      *blobCache
+	// pushed holds the original blobs of layers pushed to the registry.
+	pushed      *blobCache
+	synthesize  bool
+	synthesized *synthesisChecks
+	// synthesisQueue holds the images waiting to be checked for a
+	// synthesized manifest.
+	synthesisQueue chan string
+	// compressions holds a token for each blob being reproduced.
+	compressions chan struct{}
+	reproducing  *digestLocks
+	// pushing serializes the import of pushed images, so that layers
+	// shared by images pushed at the same time are applied only once.
+	pushing    sync.Mutex
+	indexCache *storeIndexCache
+	done       chan struct{}
+	closeOnce  sync.Once
+	closeErr   error
+	watching   sync.WaitGroup
+	// tempDirs holds the temporary directories created for the store,
+	// which are removed when it is closed.
+	tempDirs []string
+	// union is the set of stores that this one is served with, if any.
+	union *unionStore
+}
+
+// hasLayer returns whether any layer in the store has the given compressed
+// digest.
+func (cs *containerStorage) hasLayer(d digest.Digest) bool {
+	layers, err := cs.store.LayersByCompressedDigest(d)
+	if err == nil && len(layers) > 0 {
+		return true
+	}
+	layers, err = cs.store.LayersByUncompressedDigest(d)
+	return err == nil && len(layers) > 0
+}
+
+func (cs *containerStorage) listRepos(ctx context.Context) (_ []string, err error) {
+	ctx, span := cs.startSpan(ctx, "listRepos")
+	defer endSpan(span, &err)
+	idx, err := cs.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]string, 0, len(idx.repos))
+	for n := range idx.repos {
 		repos = append(repos, n)
 	}
 	return repos, nil
 }
 
-func (cs *containerStorage) listRepoRevisions(repo string) ([]string, error) {
-	images, err := cs.store.Images()
+func (cs *containerStorage) listRepoRevisions(ctx context.Context, repo string) (_ []string, err error) {
+	ctx, span := cs.startSpan(ctx, "listRepoRevisions", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	idx, err := cs.index(ctx)
 	if err != nil {
 		return nil, err
 	}
-	shas := []string{}
-	for _, i := range images {
-		for _, n := range i.Names {
-			if n == repo {
-				for _, d := range i.Digests {
-					shas = append(shas, d.Encoded())
-				}
-				continue
+	ri, ok := idx.repos[repo]
+	if !ok {
+		return []string{}, nil
+	}
+	return slices.Clone(ri.revisions.list()), nil
+}
+
+func (cs *containerStorage) listRepoLayers(ctx context.Context, repo string) (_ []string, err error) {
+	ctx, span := cs.startSpan(ctx, "listRepoLayers", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	idx, err := cs.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	shas := newShaSet()
+	if ri, ok := idx.repos[repo]; ok {
+		shas.merge(ri.layers)
+	}
+	for _, sha := range cs.stagedLayers(repo) {
+		shas.add(digest.NewDigestFromEncoded(digest.Canonical, sha))
+	}
+	return shas.list(), nil
+}
+
+func (cs *containerStorage) listRepoTags(ctx context.Context, repo string) (_ map[string]string, err error) {
+	ctx, span := cs.startSpan(ctx, "listRepoTags", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	idx, err := cs.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	ri, ok := idx.repos[repo]
+	if !ok {
+		return tags, nil
+	}
+	for _, image := range ri.images {
+		d := cs.tagDigest(ctx, image)
+		if d == "" {
+			continue
+		}
+		for _, in := range cs.imageNames(idx, image) {
+			if in.repo == repo && in.tag != "" {
+				tags[in.tag] = d.Encoded()
+			}
+		}
+	}
+	return tags, nil
+}
+
+// tagDigest returns the digest of the manifest that a tag on the image refers
+// to. When the image was pulled from a manifest list or image index, this is
+// the digest of the list so that clients can select their own platform. When
+// a manifest has been synthesized for the image because its original layers
+// cannot be reproduced, the tag refers to that instead. An image in several
+// lists is tagged with the list that has the lowest digest, so that the tag
+// refers to the same list every time.
+func (cs *containerStorage) tagDigest(ctx context.Context, image *storage.Image) digest.Digest {
+	if d := cs.synthesizedManifest(ctx, image); d != "" {
+		return d
+	}
+	manifests := manifestBigData(image)
+	if len(manifests) > 1 {
+		for _, d := range slices.Sorted(maps.Keys(manifests)) {
+			b, err := cs.store.ImageBigData(image.ID, manifests[d])
+			if err == nil && isManifestList(b) {
+				return d
 			}
 		}
 	}
-	return shas, nil
+	return image.Digest
 }
 
-func (cs *containerStorage) listRepoLayers(repo string) ([]string, error) {
-	images, err := cs.store.Images()
+// listBlobs returns the blobs whose digests begin with the given prefix.
+func (cs *containerStorage) listBlobs(ctx context.Context, prefix string) (_ []string, err error) {
+	ctx, span := cs.startSpan(ctx, "listBlobs")
+	defer endSpan(span, &err)
+	idx, err := cs.index(ctx)
 	if err != nil {
 		return nil, err
 	}
-	shas := []string{}
-	for _, i := range images {
-		for _, n := range i.Names {
-			if n == repo {
-				nextLayer := i.TopLayer
-				for nextLayer != "" {
-					layer, err := cs.store.Layer(nextLayer)
-					if err != nil {
-						return nil, err
-					}
-					shas = append(shas, layer.CompressedDigest.Encoded())
-					nextLayer = layer.Parent
-				}
-				continue
+	blobs := idx.blobsWithPrefix(prefix)
+	if staged, err := cs.staged.list(); err == nil {
+		for _, d := range staged {
+			sha := d.Encoded()
+			if strings.HasPrefix(sha, prefix) && !slices.Contains(blobs, sha) {
+				blobs = append(blobs, sha)
 			}
 		}
 	}
-	return shas, nil
+	return blobs, nil
 }
 
-func (cs *containerStorage) listBlobs() ([]string, error) {
-	images, err := cs.store.Images()
+// repoModTime returns the time at which the most recent image in a
+// repository was created. The time at which images were removed or names
+// were added to them is not recorded in the store.
+func (cs *containerStorage) repoModTime(ctx context.Context, repo string) (_ time.Time, err error) {
+	ctx, span := cs.startSpan(ctx, "repoModTime", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	idx, err := cs.index(ctx)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
-	layers, err := cs.store.Layers()
+	if repo == "" {
+		return idx.modTime, nil
+	}
+	if ri, ok := idx.repos[repo]; ok {
+		return ri.modTime, nil
+	}
+	return time.Time{}, nil
+}
+
+// blobModTime returns the time at which the first layer or image containing
+// a blob was created, or at which a pushed blob was staged. It returns the
+// zero time if the blob is not in the store.
+func (cs *containerStorage) blobModTime(ctx context.Context, sha string) (_ time.Time, err error) {
+	ctx, span := cs.startSpan(ctx, "blobModTime", attrDigest.String(sha))
+	defer endSpan(span, &err)
+	idx, err := cs.index(ctx)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
+	}
+	if t, ok := idx.created[sha]; ok {
+		return t, nil
 	}
+	t, _ := cs.staged.modTime(digest.NewDigestFromEncoded(digest.Canonical, sha))
+	return t, nil
+}
 
-	shas := make([]string, 0, len(images)+len(layers))
-	for _, i := range images {
-		for _, d := range i.Digests {
-			if d != "" {
-				shas = append(shas, d.Encoded())
-			}
+// addManifestLayers adds the layer blobs referenced by an image's manifest to
+// a set. Images whose manifests cannot be parsed are ignored, as their blobs
+// could not be served anyway.
+func (cs *containerStorage) addManifestLayers(shas *shaSet, image *storage.Image) {
+	manifestLayers, err := cs.manifestLayers(image)
+	if err != nil {
+		return
+	}
+	for _, ml := range manifestLayers {
+		shas.add(ml.digest)
+	}
+}
+
+// bigDataBlobs returns the digests of blobs, such as the image config, that
+// are stored in an image's big data using their digest as the key.
+func bigDataBlobs(image *storage.Image) []digest.Digest {
+	blobs := []digest.Digest{}
+	for _, key := range image.BigDataNames {
+		if d, err := digest.Parse(key); err == nil {
+			blobs = append(blobs, d)
 		}
 	}
-	for _, l := range layers {
-		if d := l.CompressedDigest; d != "" {
-			shas = append(shas, d.Encoded())
+	return blobs
+}
+
+// manifestBigData returns the big data keys of the manifests stored for an
+// image, indexed by digest. In addition to the image's own manifest, this
+// includes any manifest list or image index it was pulled from, which
+// containers/image stores under a "manifest-<digest>" key.
+func manifestBigData(image *storage.Image) map[digest.Digest]string {
+	manifests := map[digest.Digest]string{}
+	for _, key := range image.BigDataNames {
+		if !strings.HasPrefix(key, storage.ImageDigestBigDataKey) {
+			continue
+		}
+		if d := image.BigDataDigests[key]; d != "" {
+			manifests[d] = key
 		}
 	}
+	return manifests
+}
+
+func isManifestList(b []byte) bool {
+	var m struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return false
+	}
+	switch m.MediaType {
+	case manifestlist.MediaTypeManifestList, v1.MediaTypeImageIndex:
+		return true
+	case "":
+		// The mediaType field is optional in OCI image indexes
+		return m.Manifests != nil
+	}
+	return false
+}
 
-	return shas, nil
+// shaSet is an insertion-ordered set of sha256 digests.
+type shaSet struct {
+	seen map[string]struct{}
+	shas []string
 }
 
-func compressBlob(getBlobReader blobFunc) (blobFunc, int64, error) {
-	getDiff := func() (io.ReadCloser, error) {
-		dr, err := getBlobReader()
+func newShaSet() *shaSet {
+	return &shaSet{seen: map[string]struct{}{}}
+}
 
-		r, w := io.Pipe()
-		// containers/storage uses a custom gzip library. We want to
-		// use the stdlib one to make it more likely to match the
-		// original blob.
-		zw, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
-		if err != nil {
-			return nil, err
+func (s *shaSet) add(d digest.Digest) {
+	if d == "" || d.Algorithm() != digest.SHA256 {
+		return
+	}
+	sha := d.Encoded()
+	if _, ok := s.seen[sha]; ok {
+		return
+	}
+	s.seen[sha] = struct{}{}
+	s.shas = append(s.shas, sha)
+}
+
+// merge adds the digests in another set.
+func (s *shaSet) merge(other *shaSet) {
+	for _, sha := range other.shas {
+		if _, ok := s.seen[sha]; !ok {
+			s.seen[sha] = struct{}{}
+			s.shas = append(s.shas, sha)
 		}
-		go func() {
-			defer w.Close()
-			io.Copy(zw, dr)
-			zw.Close()
-		}()
-		return r, nil
 	}
-	r, err := getDiff()
+}
+
+func (s *shaSet) contains(sha string) bool {
+	_, ok := s.seen[sha]
+	return ok
+}
+
+func (s *shaSet) list() []string {
+	return s.shas
+}
+
+// ErrUnreproducibleBlob is returned when a layer blob cannot be reproduced
+// from the container store, because none of the available compression
+// strategies results in content matching the blob's digest.
+type ErrUnreproducibleBlob struct {
+	Digest  digest.Digest
+	LayerID string
+}
+
+func (err ErrUnreproducibleBlob) Error() string {
+	return fmt.Sprintf("cannot reproduce blob %s from layer %s: the original compression is unknown",
+		err.Digest, err.LayerID)
+}
+
+// verifyBlob checks that the content of the blob returned by getBlobReader
+// matches its digest, and returns its size.
+func verifyBlob(ctx context.Context, d digest.Digest, getBlobReader blobFunc) (_ int64, err error) {
+	_, span := startSpan(ctx, "verifyBlob", attrDigest.String(d.Encoded()))
+	defer endSpan(span, &err)
+	r, err := getBlobReader()
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
-	size, err := io.Copy(io.Discard, r)
+	defer r.Close()
+	verifier := d.Verifier()
+	size, err := io.Copy(verifier, r)
 	if err != nil {
-		return nil, 0, err
+		return 0, err
+	}
+	if !verifier.Verified() {
+		return 0, errDigestMismatch
 	}
+	return size, nil
+}
 
-	return getDiff, size, nil
+// reproduceBlob returns the blob produced by compressing the diff returned by
+// getDiff with the given compressor if its content matches the digest, and
+// errDigestMismatch otherwise.
+func (cs *containerStorage) reproduceBlob(ctx context.Context, d digest.Digest, c Compressor, getDiff blobFunc) (_ blobFunc, _ int64, err error) {
+	ctx, span := cs.startSpan(ctx, "reproduceBlob", attrDigest.String(d.Encoded()))
+	defer endSpan(span, &err)
+	// Compression is expensive, so only a limited number of blobs are
+	// reproduced at once.
+	cs.compressions <- struct{}{}
+	defer func() { <-cs.compressions }()
+	span.AddEvent("started compression")
+	return cs.cache.put(d, compressedBlob(ctx, c, getDiff))
 }
 
-func (cs *containerStorage) getBlob(sha string) (blobFunc, int64, error) {
-	errs := []error{}
-	shaDigest := digest.NewDigestFromEncoded(digest.Canonical, sha)
-	if layers, err := cs.store.LayersByCompressedDigest(shaDigest); err == nil {
-		for _, layer := range layers {
-			var diffOptions *storage.DiffOptions
-
-			getBlobReader := func() (io.ReadCloser, error) {
-				dr, err := cs.store.Diff("", layer.ID, diffOptions)
-				if err != nil {
-					return nil, fmt.Errorf("could not get diff for blob %s (layer %s): %w", sha, layer.ID, err)
-				}
-				return dr, nil
-			}
+func (cs *containerStorage) layerDiff(ctx context.Context, layer *storage.Layer, diffOptions *storage.DiffOptions) blobFunc {
+	return func() (io.ReadCloser, error) {
+		_, span := cs.startSpan(ctx, "diff", attrLayer.String(layer.ID))
+		dr, err := cs.store.Diff("", layer.ID, diffOptions)
+		if err != nil {
+			span.End()
+			return nil, fmt.Errorf("could not get diff for layer %s: %w", layer.ID, err)
+		}
+		// The span lasts until the whole diff has been read
+		return spanReadCloser{dr, span}, nil
+	}
+}
 
-			hash := sha256.New()
-			r, err := getBlobReader()
-			if err != nil {
-				return nil, 0, err
-			}
-			if _, err := io.Copy(hash, r); err != nil {
-				return nil, 0, err
+// blobLayers returns the layers that a layer blob with the given digest was
+// applied to, and the compression format of the blob.
+func (cs *containerStorage) blobLayers(ctx context.Context, d digest.Digest) ([]storage.Layer, archive.Compression, error) {
+	layers, err := cs.store.LayersByCompressedDigest(d)
+	if err == nil {
+		return layers, layers[0].CompressionType, nil
+	}
+	if !errors.Is(err, storage.ErrLayerUnknown) {
+		return nil, archive.Uncompressed, err
+	}
+
+	// Layers that were pulled partially (e.g. from zstd:chunked blobs) have
+	// no compressed digest recorded, so look for the blob in the manifests
+	// of the images that use them.
+	idx, listErr := cs.index(ctx)
+	if listErr != nil {
+		return nil, archive.Uncompressed, listErr
+	}
+	for _, image := range idx.unknown {
+		manifestLayers, mlErr := cs.manifestLayers(image)
+		if mlErr != nil {
+			continue
+		}
+		for _, ml := range manifestLayers {
+			if ml.digest != d {
+				continue
 			}
-			if digest.NewDigest(digest.Canonical, hash) == shaDigest {
-				// Layer was created with the same compression library as used
-				// by containers/storage (e.g. by buildah), so we can just
-				// return it.
-				return getBlobReader, layer.CompressedSize, nil
+			if layers, diffErr := cs.store.LayersByUncompressedDigest(ml.diffID); diffErr == nil {
+				format, _ := mediaTypeCompression(ml.mediaType)
+				return layers, format, nil
 			}
+		}
+	}
+	return nil, archive.Uncompressed, err
+}
 
-			// Digest doesn't match with default compression, so try compressing
-			// the blob using the stdlib gzip (as used by e.g. moby/moby).
-			compression := archive.Uncompressed
-			diffOptions = &storage.DiffOptions{
-				Compression: &compression,
+func (cs *containerStorage) getBlob(ctx context.Context, sha string) (_ blobFunc, _ int64, err error) {
+	ctx, span := cs.startSpan(ctx, "getBlob", attrDigest.String(sha))
+	defer endSpan(span, &err)
+	errs := []error{}
+	shaDigest := digest.NewDigestFromEncoded(digest.Canonical, sha)
+	ctx = dcontext.WithLogger(ctx, dcontext.GetLoggerWithField(ctx, "digest", shaDigest))
+	if getBlobReader, size, ok := cs.staged.get(shaDigest); ok {
+		return getBlobReader, size, nil
+	}
+	if getBlobReader, size, ok := cs.pushed.get(shaDigest); ok {
+		return getBlobReader, size, nil
+	}
+	if layers, err := cs.store.LayersByUncompressedDigest(shaDigest); err == nil && len(layers) > 0 {
+		// The uncompressed diff is always reproduced exactly, so there is
+		// no need to cache it
+		uncompressed := archive.Uncompressed
+		getDiff := cs.layerDiff(ctx, &layers[0], &storage.DiffOptions{
+			Compression: &uncompressed,
+		})
+		if layers[0].UncompressedSize > 0 {
+			return getDiff, layers[0].UncompressedSize, nil
+		}
+		size, err := verifyBlob(ctx, shaDigest, getDiff)
+		if err != nil {
+			return nil, 0, err
+		}
+		return getDiff, size, nil
+	}
+	if layers, format, err := cs.blobLayers(ctx, shaDigest); err == nil {
+		uncompressed := archive.Uncompressed
+		preferred := []string{}
+		for _, l := range layers {
+			if slices.Contains(l.BigDataNames, zstdChunkedManifestKey) {
+				preferred = append(preferred, zstdChunkedCompressor{}.Name())
 			}
-			return compressBlob(getBlobReader)
+		}
+		candidates := compressorsFor(cs.compressors, format, preferred...)
+		// Wait for any other request reproducing the same blob, so that
+		// it is found in the cache rather than being compressed again.
+		unlock := cs.reproducing.acquire(sha)
+		defer unlock()
+		if getBlobReader, size, ok := cs.cache.get(shaDigest); ok {
+			cacheCount.WithValues("Hit").Inc(1)
+			return getBlobReader, size, nil
+		}
+		cacheCount.WithValues("Miss").Inc(1)
+		// retry records a mismatch by a compressor whose output varies,
+		// which may yet reproduce the blob on a later request.
+		mismatched, retry := false, false
+		for i := range layers {
+			getDiff := cs.layerDiff(ctx, &layers[i], &storage.DiffOptions{
+				Compression: &uncompressed,
+			})
+			for _, c := range cs.memo.candidates(sha, candidates) {
+				logger := dcontext.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+					"layer":    layers[i].ID,
+					"strategy": c.Name(),
+				})
+				getBlobReader, size, err := cs.reproduceBlob(ctx, shaDigest, c, getDiff)
+				switch {
+				case err == nil:
+					compressionCount.WithValues(c.Name(), "reproduced").Inc(1)
+					logger.Debug("containerstorage: reproduced layer blob")
+					cs.memo.set(sha, c)
+					return getBlobReader, size, nil
+				case errors.Is(err, errDigestMismatch):
+					compressionCount.WithValues(c.Name(), "mismatch").Inc(1)
+					logger.Debug("containerstorage: layer blob not reproduced")
+					if isDeterministic(c) {
+						mismatched = true
+					} else {
+						retry = true
+					}
+					continue
+				case errors.Is(err, errCompressorUnavailable):
+					compressionCount.WithValues(c.Name(), "unavailable").Inc(1)
+					logger.Debugf("containerstorage: %v", err)
+					continue
+				}
+				compressionCount.WithValues(c.Name(), "error").Inc(1)
+				logger.Errorf("containerstorage: error reproducing layer blob: %v", err)
+				return nil, 0, err
+			}
+		}
+		if mismatched && !retry {
+			// Compressors that were unavailable may be installed later,
+			// and those whose output varies may match on another run,
+			// so only a blob that some compressor failed to reproduce,
+			// and that no such compressor may yet reproduce, is
+			// remembered as unreproducible. It is counted once, when it
+			// is first found to be, not on each request for it.
+			cs.memo.set(sha, nil)
+			unreproducibleCount.Inc(1)
+			dcontext.GetLoggerWithField(ctx, "layer", layers[0].ID).Warn("containerstorage: layer blob cannot be reproduced")
+		}
+		return nil, 0, ErrUnreproducibleBlob{
+			Digest:  shaDigest,
+			LayerID: layers[0].ID,
 		}
 	} else {
+		if errors.Is(err, storage.ErrLayerUnknown) {
+			// The layer has been removed from the store
+			cs.cache.remove(shaDigest)
+			cs.pushed.remove(shaDigest)
+		}
 		errs = append(errs, err)
 	}
 
 	if images, err := cs.store.ImagesByDigest(shaDigest); err == nil {
 		for _, image := range images {
-			b, err := cs.store.ImageBigData(image.ID, storage.ImageDigestBigDataKey)
+			key, ok := manifestBigData(image)[shaDigest]
+			if !ok {
+				continue
+			}
+			b, err := cs.store.ImageBigData(image.ID, key)
 			if err == nil {
-				return func() (io.ReadCloser, error) {
-					return io.NopCloser(bytes.NewReader(b)), nil
-				}, int64(len(b)), nil
+				return bytesBlobFunc(b), int64(len(b)), nil
 			}
 			errs = append(errs, fmt.Errorf("could not get manifest data for blob %s: %w", sha, err))
 		}
 	} else {
 		errs = append(errs, err)
 	}
-	if image, err := cs.store.Image(shaDigest.Encoded()); err == nil {
-		b, err := cs.store.ImageBigData(image.ID, shaDigest.String())
-		if err == nil {
-			return func() (io.ReadCloser, error) {
-				return io.NopCloser(bytes.NewReader(b)), nil
-			}, int64(len(b)), nil
+	if idx, err := cs.index(ctx); err == nil {
+		for _, image := range idx.bigData[shaDigest] {
+			b, err := cs.store.ImageBigData(image.ID, shaDigest.String())
+			if err == nil {
+				return bytesBlobFunc(b), int64(len(b)), nil
+			}
+			errs = append(errs, fmt.Errorf("could not get image data for blob %s: %w", sha, err))
 		}
-		errs = append(errs, fmt.Errorf("could not get manifest data for blob %s: %w", sha, err))
 	} else {
 		errs = append(errs, err)
 	}
 
-	return nil, 0, fmt.Errorf("blob %s not found: %w", sha, errors.Join(errs...))
+	return nil, 0, fmt.Errorf("blob %s %w: %w", sha, errNotFound, errors.Join(errs...))
 }
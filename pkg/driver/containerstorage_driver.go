@@ -1,39 +1,103 @@
 package driver
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"time"
 
+	dcontext "github.com/distribution/distribution/v3/context"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/base"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 )
 
+const driverName = "containerstorage"
+
 type containerstorageDriverFactory struct{}
 
 func init() {
-	factory.Register("containerstorage", containerstorageDriverFactory{})
+	factory.Register(driverName, containerstorageDriverFactory{})
 }
 
 func (containerstorageDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
-	store, err := newContainerStorage()
+	params, err := fromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newStore(params)
 	if err != nil {
 		return nil, err
 	}
-	return base.NewRegulator(&driver{
-		store: store,
-	}, 1), nil
+	d := &driver{
+		store:       store,
+		allowDelete: params.allowDelete,
+	}
+	openDriversLock.Lock()
+	openDrivers[d] = struct{}{}
+	openDriversLock.Unlock()
+	return closableDriver{base.NewRegulator(d, params.maxThreads), d}, nil
+}
+
+// closableDriver is the driver returned by the factory, which limits the
+// number of concurrent calls to it and can be closed.
+type closableDriver struct {
+	storagedriver.StorageDriver
+	d *driver
+}
+
+// Close closes the driver; see driver.Close.
+func (cd closableDriver) Close() error {
+	return cd.d.Close()
+}
+
+var (
+	openDriversLock sync.Mutex
+	// openDrivers holds the drivers created by the factory that have not
+	// yet been closed.
+	openDrivers = map[*driver]struct{}{}
+)
+
+// Close closes every driver created by the factory that has not already been
+// closed. The registry does not close its storage driver, so programs that
+// embed it should call this once it has shut down.
+func Close() error {
+	openDriversLock.Lock()
+	drivers := make([]*driver, 0, len(openDrivers))
+	for d := range openDrivers {
+		drivers = append(drivers, d)
+	}
+	openDriversLock.Unlock()
+	var errs []error
+	for _, d := range drivers {
+		if err := d.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 type driver struct {
-	store store
+	store       store
+	allowDelete bool
+}
+
+// Close stops watching the driver's container stores, shuts them down and
+// removes the temporary directories in which it keeps blobs. The driver must
+// not be used afterwards.
+func (d *driver) Close() error {
+	openDriversLock.Lock()
+	delete(openDrivers, d)
+	openDriversLock.Unlock()
+	return d.store.close()
 }
 
 func (d *driver) Name() string {
-	return "containerstorage"
+	return driverName
 }
 
 type pseudoFile interface {
@@ -43,6 +107,9 @@ type pseudoFile interface {
 }
 
 type filePath struct {
+	// ctx is that of the request for the file, with a logger that
+	// records its path.
+	ctx     context.Context
 	subPath string
 	store   store
 }
@@ -60,8 +127,26 @@ func (fp *filePath) children(child ...string) []string {
 	return paths
 }
 
+// dirInfo returns the FileInfo of a directory whose modification time is that
+// of a repository, or if repo is empty that of the whole store.
+func (fp *filePath) dirInfo(repo string) (storagedriver.FileInfo, error) {
+	modTime, err := fp.store.repoModTime(fp.ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return storagedriver.FileInfoInternal{
+		FileInfoFields: storagedriver.FileInfoFields{
+			Path:    fp.path(),
+			IsDir:   true,
+			ModTime: modTime,
+		},
+	}, nil
+}
+
 type dir struct {
-	path []string
+	ctx   context.Context
+	path  []string
+	store store
 }
 
 func (d *dir) Reader() (io.ReadCloser, error) {
@@ -69,10 +154,15 @@ func (d *dir) Reader() (io.ReadCloser, error) {
 }
 
 func (d *dir) Stat() (storagedriver.FileInfo, error) {
+	modTime, err := d.store.repoModTime(d.ctx, "")
+	if err != nil {
+		return nil, err
+	}
 	return storagedriver.FileInfoInternal{
-		storagedriver.FileInfoFields{
-			Path:  "/" + strings.Join(d.path, "/"),
-			IsDir: true,
+		FileInfoFields: storagedriver.FileInfoFields{
+			Path:    "/" + strings.Join(d.path, "/"),
+			IsDir:   true,
+			ModTime: modTime,
 		},
 	}, nil
 }
@@ -116,10 +206,12 @@ func (d *driver) getFile(ctx context.Context, path string) (pseudoFile, error) {
 			return nil, storagedriver.PathNotFoundError{Path: path}
 		}
 	}
+	ctx = dcontext.WithLogger(ctx, dcontext.GetLoggerWithField(ctx, "path", path))
 	if len(segments) < 4 {
-		return &dir{path: segments}, nil
+		return &dir{ctx: ctx, path: segments, store: d.store}, nil
 	}
 	file := filePath{
+		ctx:     ctx,
 		store:   d.store,
 		subPath: strings.Join(segments[3:], "/"),
 	}
@@ -161,12 +253,19 @@ func (d *driver) getFile(ctx context.Context, path string) (pseudoFile, error) {
 				filePath: file,
 				repo:     repoName,
 			}, nil
+		case "_uploads":
+			return &upload{
+				filePath: file,
+				repo:     repoName,
+			}, nil
 		}
 	}
 	return nil, storagedriver.PathNotFoundError{Path: path}
 }
 
-func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+func (d *driver) GetContent(ctx context.Context, path string) (_ []byte, err error) {
+	ctx, span := startSpan(ctx, "GetContent", attrPath.String(path))
+	defer endSpan(span, &err)
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
@@ -178,10 +277,13 @@ func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 	return io.ReadAll(reader)
 }
 
-func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (_ io.ReadCloser, err error) {
+	ctx, span := startSpan(ctx, "Reader", attrPath.String(path))
+	defer endSpan(span, &err)
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	start := time.Now()
 	f, err := d.getFile(ctx, path)
 	if err != nil {
 		return nil, err
@@ -192,14 +294,25 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 		return nil, err
 	}
 	if offset > 0 {
-		if _, err := io.Copy(io.Discard, io.LimitReader(r, offset)); err != nil {
+		if s, ok := r.(io.Seeker); ok {
+			_, err = s.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.Copy(io.Discard, io.LimitReader(r, offset))
+		}
+		if err != nil {
+			r.Close()
 			return nil, err
 		}
 	}
+	if _, ok := f.(*blob); ok {
+		return newFirstByteReader(r, start), nil
+	}
 	return r, nil
 }
 
-func (d *driver) Stat(ctx context.Context, subPath string) (storagedriver.FileInfo, error) {
+func (d *driver) Stat(ctx context.Context, subPath string) (_ storagedriver.FileInfo, err error) {
+	ctx, span := startSpan(ctx, "Stat", attrPath.String(subPath))
+	defer endSpan(span, &err)
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
@@ -211,7 +324,9 @@ func (d *driver) Stat(ctx context.Context, subPath string) (storagedriver.FileIn
 	return f.Stat()
 }
 
-func (d *driver) List(ctx context.Context, subPath string) ([]string, error) {
+func (d *driver) List(ctx context.Context, subPath string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "List", attrPath.String(subPath))
+	defer endSpan(span, &err)
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
@@ -227,22 +342,98 @@ func (d *driver) URLFor(ctx context.Context, path string, options map[string]int
 	return "", storagedriver.ErrUnsupportedMethod{}
 }
 
-func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) (err error) {
+	ctx, span := startSpan(ctx, "Walk", attrPath.String(path))
+	defer endSpan(span, &err)
 	return storagedriver.WalkFallback(ctx, d, path, f)
 }
 
-func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
-	return storagedriver.ErrUnsupportedMethod{}
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) (err error) {
+	ctx, span := startSpan(ctx, "PutContent", attrPath.String(path))
+	defer endSpan(span, &err)
+	f, err := d.getFile(ctx, path)
+	if err != nil {
+		return err
+	}
+	switch f := f.(type) {
+	case *blob:
+		sha, err := f.sha()
+		if err != nil {
+			return err
+		}
+		return d.store.putBlob(ctx, sha, bytes.NewReader(contents))
+	case *link:
+		return f.put(contents)
+	case *upload:
+		return f.put(contents)
+	}
+	return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
 }
 
-func (d *driver) Writer(ctx context.Context, subPath string, append bool) (storagedriver.FileWriter, error) {
-	return nil, storagedriver.ErrUnsupportedMethod{}
+func (d *driver) Writer(ctx context.Context, subPath string, append bool) (_ storagedriver.FileWriter, err error) {
+	ctx, span := startSpan(ctx, "Writer", attrPath.String(subPath))
+	defer endSpan(span, &err)
+	f, err := d.getFile(ctx, subPath)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := f.(*upload); ok {
+		return u.writer(append)
+	}
+	return nil, storagedriver.ErrUnsupportedMethod{DriverName: driverName}
 }
 
-func (d *driver) Move(ctx context.Context, sourcePath, destPath string) error {
-	return storagedriver.ErrUnsupportedMethod{}
+func (d *driver) Move(ctx context.Context, sourcePath, destPath string) (err error) {
+	ctx, span := startSpan(ctx, "Move", attrPath.String(sourcePath), attrDestination.String(destPath))
+	defer endSpan(span, &err)
+	src, err := d.getFile(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	dest, err := d.getFile(ctx, destPath)
+	if err != nil {
+		return err
+	}
+	u, ok := src.(*upload)
+	b, isBlob := dest.(*blob)
+	if !ok || !isBlob {
+		return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+	sha, err := b.sha()
+	if err != nil {
+		return err
+	}
+	if _, err := u.Stat(); err != nil {
+		return err
+	}
+	return d.store.moveUpload(ctx, u.repo, u.uploadSubPath(), sha)
 }
 
-func (d *driver) Delete(ctx context.Context, subPath string) error {
-	return storagedriver.ErrUnsupportedMethod{}
+func (d *driver) Delete(ctx context.Context, subPath string) (err error) {
+	ctx, span := startSpan(ctx, "Delete", attrPath.String(subPath))
+	defer endSpan(span, &err)
+	f, err := d.getFile(ctx, subPath)
+	if err != nil {
+		return err
+	}
+	if u, ok := f.(*upload); ok {
+		return u.delete()
+	}
+	if !d.allowDelete {
+		return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+	switch f := f.(type) {
+	case *manifestList:
+		err = f.delete()
+	case *link:
+		err = f.delete()
+	case *blobList:
+		err = f.delete()
+	default:
+		return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+	if errors.Is(err, errNotFound) {
+		return storagedriver.PathNotFoundError{Path: subPath}
+	}
+	return err
 }
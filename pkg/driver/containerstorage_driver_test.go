@@ -5,24 +5,29 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
 	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const testRepo = "foo/bar"
 
+var testModTime = time.Date(2023, time.March, 14, 15, 9, 26, 0, time.UTC)
+
 type fakeStore struct{}
 
-func (fs fakeStore) listRepos() ([]string, error) {
+func (fs fakeStore) listRepos(ctx context.Context) ([]string, error) {
 	return []string{testRepo}, nil
 }
 
-func (fs fakeStore) listRepoRevisions(repo string) ([]string, error) {
+func (fs fakeStore) listRepoRevisions(ctx context.Context, repo string) ([]string, error) {
 	if repo != testRepo {
 		return nil, fmt.Errorf("non-existent repo %v", repo)
 	}
@@ -31,7 +36,7 @@ func (fs fakeStore) listRepoRevisions(repo string) ([]string, error) {
 	}, nil
 }
 
-func (fs fakeStore) listRepoLayers(repo string) ([]string, error) {
+func (fs fakeStore) listRepoLayers(ctx context.Context, repo string) ([]string, error) {
 	if repo != testRepo {
 		return nil, fmt.Errorf("non-existent repo %v", repo)
 	}
@@ -54,20 +59,35 @@ func (fs fakeStore) listRepoLayers(repo string) ([]string, error) {
 	}, nil
 }
 
-func (fs fakeStore) listBlobs() ([]string, error) {
-	revs, err := fs.listRepoRevisions(testRepo)
+func (fs fakeStore) listRepoTags(ctx context.Context, repo string) (map[string]string, error) {
+	if repo != testRepo {
+		return nil, fmt.Errorf("non-existent repo %v", repo)
+	}
+	return map[string]string{
+		"latest": "e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270",
+	}, nil
+}
+
+func (fs fakeStore) listBlobs(ctx context.Context, prefix string) ([]string, error) {
+	revs, err := fs.listRepoRevisions(ctx, testRepo)
 	if err != nil {
 		return nil, err
 	}
-	layers, err := fs.listRepoLayers(testRepo)
+	layers, err := fs.listRepoLayers(ctx, testRepo)
 	if err != nil {
 		return nil, err
 	}
-	return append(revs, layers...), nil
+	blobs := []string{}
+	for _, sha := range append(revs, layers...) {
+		if strings.HasPrefix(sha, prefix) {
+			blobs = append(blobs, sha)
+		}
+	}
+	return blobs, nil
 }
 
-func (fs fakeStore) getBlob(sha string) (blobFunc, int64, error) {
-	blobs, err := fs.listBlobs()
+func (fs fakeStore) getBlob(ctx context.Context, sha string) (blobFunc, int64, error) {
+	blobs, err := fs.listBlobs(ctx, sha)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -81,6 +101,58 @@ func (fs fakeStore) getBlob(sha string) (blobFunc, int64, error) {
 	return nil, 0, fmt.Errorf("non-existent blob %v", sha)
 }
 
+func (fs fakeStore) repoModTime(ctx context.Context, repo string) (time.Time, error) {
+	return testModTime, nil
+}
+
+func (fs fakeStore) blobModTime(ctx context.Context, sha string) (time.Time, error) {
+	return testModTime, nil
+}
+
+func (fs fakeStore) uploadPath(repo, subPath string) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) putBlob(ctx context.Context, sha string, content io.Reader) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) moveUpload(ctx context.Context, repo, subPath, sha string) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) linkLayer(ctx context.Context, repo, sha string) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) putManifest(ctx context.Context, repo, sha string) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) putTag(ctx context.Context, repo, tag, sha string) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) deleteTag(ctx context.Context, repo, tag string) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) deleteManifest(ctx context.Context, repo, sha string) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) deleteLayerLink(ctx context.Context, repo, sha string) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) deleteBlob(ctx context.Context, sha string) error {
+	return storagedriver.ErrUnsupportedMethod{}
+}
+
+func (fs fakeStore) close() error {
+	return nil
+}
+
 const expectedFiles = `/docker
 /docker/registry
 /docker/registry/v2
@@ -173,6 +245,14 @@ const expectedFiles = `/docker
 /docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256
 /docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256/e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270
 /docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256/e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270/link
+/docker/registry/v2/repositories/foo/bar/_manifests/tags
+/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest
+/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/current
+/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/current/link
+/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/index
+/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/index/sha256
+/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/index/sha256/e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270
+/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/index/sha256/e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270/link
 `
 
 func TestWalk(t *testing.T) {
@@ -186,6 +266,10 @@ func TestWalk(t *testing.T) {
 		err := d.Walk(ctx,
 			"/", func(fileInfo storagedriver.FileInfo) error {
 				files = append(files, fileInfo.Path()+"\n")
+				assert.Equal(t, testModTime, fileInfo.ModTime(), fileInfo.Path())
+				if strings.HasSuffix(fileInfo.Path(), "/link") {
+					assert.Equal(t, int64(len("sha256:")+64), fileInfo.Size(), fileInfo.Path())
+				}
 				return nil
 			})
 		return files, err
@@ -194,3 +278,66 @@ func TestWalk(t *testing.T) {
 	sort.Strings(files)
 	assert.Equal(t, expectedFiles, strings.Join(files, ""))
 }
+
+func TestTagLinks(t *testing.T) {
+	d := driver{
+		store: fakeStore{},
+	}
+	ctx := context.Background()
+
+	content, err := d.GetContent(ctx, "/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/current/link")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270", string(content))
+
+	_, err = d.GetContent(ctx, "/docker/registry/v2/repositories/foo/bar/_manifests/tags/missing/current/link")
+	assert.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	_, err = d.Stat(ctx, "/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/index/sha256/0d557d32f54ebd277fdffbbdf656b90442ee9d8753aec9ebac429eee967f4dee/link")
+	assert.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	content, err = d.GetContent(ctx, "/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/index/sha256/e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270/link")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270", string(content))
+
+	_, err = d.GetContent(ctx, "/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/index/sha512/e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270/link")
+	assert.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	tags, err := d.List(ctx, "/docker/registry/v2/repositories/foo/bar/_manifests/tags")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest"}, tags)
+}
+
+func TestClose(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("TMPDIR", root)
+	createDriver := func(name string) storagedriver.StorageDriver {
+		d, err := factory.Create(driverName, map[string]interface{}{
+			"graphroot":     filepath.Join(root, name, "graph"),
+			"runroot":       filepath.Join(root, name, "run"),
+			"driver":        "vfs",
+			"driveroptions": []interface{}{},
+		})
+		require.NoError(t, err)
+		return d
+	}
+	tempDirs := func() []string {
+		dirs, err := filepath.Glob(filepath.Join(root, "containerstorage-*"))
+		require.NoError(t, err)
+		return dirs
+	}
+	first := createDriver("first")
+	createDriver("second")
+	t.Cleanup(func() { Close() })
+	assert.Len(t, tempDirs(), 4)
+
+	// Each driver can be closed by itself
+	closer, ok := first.(io.Closer)
+	require.True(t, ok)
+	assert.NoError(t, closer.Close())
+	assert.Len(t, tempDirs(), 2)
+
+	// The rest are closed together
+	assert.NoError(t, Close())
+	assert.Empty(t, openDrivers)
+	assert.Empty(t, tempDirs())
+}
@@ -0,0 +1,850 @@
+package driver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// Applying layer diffs runs a helper in a re-executed child process.
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func newTestStorage(t *testing.T) *containerStorage {
+	t.Helper()
+	return newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions": []interface{}{},
+	})
+}
+
+// newTestStorageWithParams returns a store using the vfs driver in a
+// temporary directory, configured with the given additional parameters.
+func newTestStorageWithParams(t *testing.T, parameters map[string]interface{}) *containerStorage {
+	t.Helper()
+	root := t.TempDir()
+	// Keep the spool directory within the test's temporary directory
+	t.Setenv("TMPDIR", root)
+	parameters["graphroot"] = root + "/graph"
+	parameters["runroot"] = root + "/run"
+	parameters["driver"] = "vfs"
+	params, err := fromParameters(parameters)
+	require.NoError(t, err)
+	cs, err := newContainerStorage(params)
+	require.NoError(t, err)
+	t.Cleanup(func() { cs.close() })
+	return cs
+}
+
+// testLayerTar returns an uncompressed layer tarball containing a single file.
+func testLayerTar(t *testing.T, name, content string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+	}))
+	_, err := tw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+// compressTestLayer compresses a layer tarball the same way containers/storage
+// does when it recompresses a diff.
+func compressTestLayer(t *testing.T, layerTar []byte, compression archive.Compression) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w, err := archive.CompressStream(buf, compression)
+	require.NoError(t, err)
+	_, err = w.Write(layerTar)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// gzipTestLayer compresses a layer tarball using the stdlib gzip library.
+func gzipTestLayer(t *testing.T, layerTar []byte, level int) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, level)
+	require.NoError(t, err)
+	_, err = w.Write(layerTar)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+type testImage struct {
+	id       string
+	manifest digest.Digest
+	config   digest.Digest
+	layers   []digest.Digest
+	diffIDs  []digest.Digest
+}
+
+// testMediaTypes holds the media types with which a test image's manifest
+// describes itself, its config and its gzip-compressed layers.
+type testMediaTypes struct {
+	manifest, config, gzipLayer string
+}
+
+var (
+	ociTestMediaTypes = testMediaTypes{
+		manifest:  "application/vnd.oci.image.manifest.v1+json",
+		config:    "application/vnd.oci.image.config.v1+json",
+		gzipLayer: "application/vnd.oci.image.layer.v1.tar+gzip",
+	}
+	dockerTestMediaTypes = testMediaTypes{
+		manifest:  "application/vnd.docker.distribution.manifest.v2+json",
+		config:    "application/vnd.docker.container.image.v1+json",
+		gzipLayer: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+	}
+)
+
+// addTestImage stores an image whose layers are the given compressed blobs,
+// applied in order, together with an OCI manifest and config.
+func addTestImage(t *testing.T, cs *containerStorage, names []string, blobs ...[]byte) testImage {
+	t.Helper()
+	return addTestImageWithMediaTypes(t, cs, ociTestMediaTypes, names, blobs...)
+}
+
+// addTestImageWithMediaTypes stores an image like addTestImage, with a
+// manifest using the given media types.
+func addTestImageWithMediaTypes(t *testing.T, cs *containerStorage, mediaTypes testMediaTypes, names []string, blobs ...[]byte) testImage {
+	t.Helper()
+	img := testImage{}
+	parent := ""
+	type descriptor struct {
+		MediaType string        `json:"mediaType"`
+		Digest    digest.Digest `json:"digest"`
+		Size      int64         `json:"size"`
+	}
+	layerDescs := []descriptor{}
+	diffIDs := []digest.Digest{}
+	for _, b := range blobs {
+		layer, _, err := cs.store.PutLayer("", parent, nil, "", false, nil, bytes.NewReader(b))
+		require.NoError(t, err)
+		parent = layer.ID
+		img.layers = append(img.layers, layer.CompressedDigest)
+		mediaType := mediaTypes.gzipLayer
+		switch layer.CompressionType {
+		case archive.Zstd:
+			mediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+		case archive.Uncompressed:
+			mediaType = "application/vnd.oci.image.layer.v1.tar"
+		}
+		layerDescs = append(layerDescs, descriptor{
+			MediaType: mediaType,
+			Digest:    layer.CompressedDigest,
+			Size:      layer.CompressedSize,
+		})
+		diffIDs = append(diffIDs, layer.UncompressedDigest)
+	}
+	img.diffIDs = diffIDs
+
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": diffIDs,
+		},
+	})
+	require.NoError(t, err)
+	img.config = digest.FromBytes(config)
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypes.manifest,
+		"config": descriptor{
+			MediaType: mediaTypes.config,
+			Digest:    img.config,
+			Size:      int64(len(config)),
+		},
+		"layers": layerDescs,
+	})
+	require.NoError(t, err)
+	img.manifest = digest.FromBytes(manifest)
+
+	image, err := cs.store.CreateImage(img.config.Encoded(), names, parent, "", &storage.ImageOptions{
+		Digest: img.manifest,
+		BigData: []storage.ImageBigDataOption{
+			{Key: img.config.String(), Data: config, Digest: img.config},
+			{Key: storage.ImageDigestBigDataKey, Data: manifest, Digest: img.manifest},
+		},
+	})
+	require.NoError(t, err)
+	img.id = image.ID
+	return img
+}
+
+func readTestBlob(t *testing.T, cs *containerStorage, d digest.Digest) []byte {
+	t.Helper()
+	getBlobReader, size, err := cs.getBlob(context.Background(), d.Encoded())
+	require.NoError(t, err)
+	r, err := getBlobReader()
+	require.NoError(t, err)
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(b)), size)
+	return b
+}
+
+func TestConfigBlobs(t *testing.T) {
+	cs := newTestStorage(t)
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	blobs, err := cs.listBlobs(context.Background(), "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		img.manifest.Encoded(),
+		img.config.Encoded(),
+		img.layers[0].Encoded(),
+		img.diffIDs[0].Encoded(),
+	}, blobs)
+
+	repoLayers, err := cs.listRepoLayers(context.Background(), "localhost/foo")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		img.config.Encoded(),
+		img.layers[0].Encoded(),
+		img.diffIDs[0].Encoded(),
+	}, repoLayers)
+
+	config := readTestBlob(t, cs, img.config)
+	assert.Equal(t, img.config, digest.FromBytes(config))
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+}
+
+func TestUncompressedBlobs(t *testing.T) {
+	cs := newTestStorage(t)
+	layerTar := testLayerTar(t, "hello", "Hello, World!")
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layerTar)
+	assert.Equal(t, digest.FromBytes(layerTar), img.layers[0])
+	assert.Equal(t, layerTar, readTestBlob(t, cs, img.layers[0]))
+
+	// Compressed layers can also be fetched by their diff ID
+	layerTar = testLayerTar(t, "goodbye", "Goodbye, World!")
+	layer := compressTestLayer(t, layerTar, archive.Gzip)
+	img = addTestImage(t, cs, []string{"localhost/bar:latest"}, layer)
+	assert.Equal(t, digest.FromBytes(layerTar), img.diffIDs[0])
+	assert.Equal(t, layerTar, readTestBlob(t, cs, img.diffIDs[0]))
+	assert.True(t, cs.hasLayer(img.diffIDs[0]))
+
+	blobs, err := cs.listBlobs(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Contains(t, blobs, img.diffIDs[0].Encoded())
+}
+
+func TestManifestList(t *testing.T) {
+	cs := newTestStorage(t)
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests": []map[string]interface{}{
+			{
+				"mediaType": "application/vnd.oci.image.manifest.v1+json",
+				"digest":    img.manifest,
+				"size":      len(readTestBlob(t, cs, img.manifest)),
+				"platform":  map[string]string{"architecture": "amd64", "os": "linux"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	indexDigest := digest.FromBytes(index)
+	require.NoError(t, cs.store.SetImageBigData(img.id, "manifest-"+indexDigest.String(), index,
+		func(b []byte) (digest.Digest, error) { return digest.FromBytes(b), nil }))
+
+	revisions, err := cs.listRepoRevisions(context.Background(), "localhost/foo")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{img.manifest.Encoded(), indexDigest.Encoded()}, revisions)
+
+	tags, err := cs.listRepoTags(context.Background(), "localhost/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": indexDigest.Encoded()}, tags)
+
+	assert.Equal(t, index, readTestBlob(t, cs, indexDigest))
+	assert.Equal(t, img.manifest, digest.FromBytes(readTestBlob(t, cs, img.manifest)))
+}
+
+func TestManifestListsTagDigest(t *testing.T) {
+	cs := newTestStorage(t)
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	var lists []digest.Digest
+	for _, arch := range []string{"amd64", "arm64", "ppc64le", "s390x"} {
+		index, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.index.v1+json",
+			"manifests": []map[string]interface{}{
+				{
+					"mediaType": "application/vnd.oci.image.manifest.v1+json",
+					"digest":    img.manifest,
+					"size":      len(readTestBlob(t, cs, img.manifest)),
+					"platform":  map[string]string{"architecture": arch, "os": "linux"},
+				},
+			},
+		})
+		require.NoError(t, err)
+		d := digest.FromBytes(index)
+		require.NoError(t, cs.store.SetImageBigData(img.id, "manifest-"+d.String(), index,
+			func(b []byte) (digest.Digest, error) { return digest.FromBytes(b), nil }))
+		lists = append(lists, d)
+	}
+	slices.Sort(lists)
+
+	for range 10 {
+		tags, err := cs.listRepoTags(context.Background(), "localhost/foo")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"latest": lists[0].Encoded()}, tags)
+	}
+}
+
+func TestCachedBlobs(t *testing.T) {
+	cs := newTestStorage(t)
+	var err error
+	cs.cache, err = newBlobCache(t.TempDir(), 0, cs.hasLayer)
+	require.NoError(t, err)
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+	_, size, ok := cs.cache.get(img.layers[0])
+	assert.True(t, ok)
+	assert.Equal(t, int64(len(layer)), size)
+
+	_, err = cs.store.DeleteImage(img.id, true)
+	require.NoError(t, err)
+	_, _, err = cs.getBlob(context.Background(), img.layers[0].Encoded())
+	assert.Error(t, err)
+	_, _, ok = cs.cache.get(img.layers[0])
+	assert.False(t, ok)
+}
+
+func TestReaderOffset(t *testing.T) {
+	cs := newTestStorage(t)
+	first := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	second := compressTestLayer(t, testLayerTar(t, "goodbye", "Goodbye, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, first, second)
+	d := &driver{store: cs}
+
+	for _, tc := range []struct {
+		layer  []byte
+		digest digest.Digest
+	}{
+		{first, img.layers[0]},
+		{second, img.layers[1]},
+	} {
+		path := "/docker/registry/v2/blobs/sha256/" + tc.digest.Encoded()[:2] + "/" + tc.digest.Encoded() + "/data"
+		offset := int64(len(tc.layer) / 2)
+		r, err := d.Reader(context.Background(), path, offset)
+		require.NoError(t, err)
+		_, seekable := r.(io.Seeker)
+		assert.True(t, seekable, "blob should be read from the spool")
+		b, err := io.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		assert.Equal(t, tc.layer[offset:], b)
+	}
+
+	// Both blobs remain spooled, so neither need be compressed again
+	_, _, ok := cs.cache.get(img.layers[0])
+	assert.True(t, ok)
+	_, _, ok = cs.cache.get(img.layers[1])
+	assert.True(t, ok)
+}
+
+func TestCloseRemovesTempDirs(t *testing.T) {
+	cs := newTestStorage(t)
+	require.Len(t, cs.tempDirs, 2)
+	for _, dir := range cs.tempDirs {
+		assert.DirExists(t, dir)
+	}
+	assert.Equal(t, defaultSpoolSize, cs.cache.maxSize)
+
+	assert.NoError(t, cs.close())
+	for _, dir := range cs.tempDirs {
+		assert.NoDirExists(t, dir)
+	}
+}
+
+func TestStdlibGzipBlob(t *testing.T) {
+	cs := newTestStorage(t)
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.DefaultCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+}
+
+func TestUnreproducibleBlob(t *testing.T) {
+	cs := newTestStorage(t)
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.NoCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	logger, hook := logtest.NewNullLogger()
+	ctx := dcontext.WithLogger(context.Background(), logrus.NewEntry(logger))
+	_, _, err := cs.getBlob(ctx, img.layers[0].Encoded())
+	assert.ErrorAs(t, err, &ErrUnreproducibleBlob{})
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.WarnLevel, entry.Level)
+		assert.Equal(t, img.layers[0], entry.Data["digest"])
+		assert.Contains(t, entry.Data, "layer")
+	}
+
+	d := driver{store: cs}
+	_, err = d.Stat(context.Background(), "/docker/registry/v2/blobs/sha256/"+
+		img.layers[0].Encoded()[:2]+"/"+img.layers[0].Encoded()+"/data")
+	assert.ErrorAs(t, err, &storagedriver.Error{})
+}
+
+func TestCompressorSearch(t *testing.T) {
+	cs := newTestStorage(t)
+	layerTar := testLayerTar(t, "hello", "Hello, World!")
+	bestLayer := gzipTestLayer(t, layerTar, gzip.BestCompression)
+	unknownLayer := gzipTestLayer(t, testLayerTar(t, "goodbye", "Goodbye!"), gzip.NoCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, bestLayer, unknownLayer)
+
+	assert.Equal(t, bestLayer, readTestBlob(t, cs, img.layers[0]))
+	candidates := cs.memo.candidates(img.layers[0].Encoded(), cs.compressors)
+	if assert.Len(t, candidates, 1) {
+		assert.Equal(t, "gzip-9", candidates[0].Name())
+	}
+
+	_, _, err := cs.getBlob(context.Background(), img.layers[1].Encoded())
+	assert.ErrorAs(t, err, &ErrUnreproducibleBlob{})
+	assert.Empty(t, cs.memo.candidates(img.layers[1].Encoded(), cs.compressors))
+}
+
+func TestCompressorAliases(t *testing.T) {
+	all, err := getCompressors([]string{"gzip", "gzip-6", "klauspost-gzip-5", "klauspost-gzip", "gzip-1"})
+	require.NoError(t, err)
+	names := []string{}
+	for _, c := range compressorsFor(all, archive.Gzip) {
+		names = append(names, c.Name())
+	}
+	assert.Equal(t, []string{"gzip", "klauspost-gzip-5", "gzip-1"}, names)
+
+	// Aliases produce the same output as the compressors they stand for
+	layerTar := testLayerTar(t, "hello", "Hello, World!")
+	compress := func(c Compressor) []byte {
+		buf := &bytes.Buffer{}
+		w, err := c.NewWriter(buf)
+		require.NoError(t, err)
+		_, err = w.Write(layerTar)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+	assert.Equal(t, compress(all[0]), compress(all[1]))
+	assert.Equal(t, compress(all[3]), compress(all[2]))
+}
+
+func TestGzipHeaderBlob(t *testing.T) {
+	cs := newTestStorage(t)
+	header := gzip.Header{
+		Name:    "layer.tar",
+		ModTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		OS:      3,
+	}
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Header = header
+	_, err := w.Write(testLayerTar(t, "hello", "Hello, World!"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	layer := buf.Bytes()
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	cs.compressors = append(cs.compressors, NewGzipCompressor("test-gzip-header", gzip.DefaultCompression, header))
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+	candidates := cs.memo.candidates(img.layers[0].Encoded(), cs.compressors)
+	if assert.Len(t, candidates, 1) {
+		assert.Equal(t, "test-gzip-header", candidates[0].Name())
+	}
+}
+
+// unavailableCompressor is a gzip compressor that cannot be used.
+type unavailableCompressor struct{}
+
+func (unavailableCompressor) Name() string {
+	return "test-unavailable"
+}
+
+func (unavailableCompressor) Format() archive.Compression {
+	return archive.Gzip
+}
+
+func (unavailableCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nil, errCompressorUnavailable
+}
+
+func TestUnavailableCompressorNotMemoized(t *testing.T) {
+	cs := newTestStorage(t)
+	cs.compressors = []Compressor{unavailableCompressor{}}
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	_, _, err := cs.getBlob(context.Background(), img.layers[0].Encoded())
+	assert.ErrorAs(t, err, &ErrUnreproducibleBlob{})
+	assert.Len(t, cs.memo.candidates(img.layers[0].Encoded(), cs.compressors), 1)
+
+	cs.compressors = append(cs.compressors, archiveCompressor{"pgzip", archive.Gzip})
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+}
+
+// varyingCompressor is a gzip compressor whose output is taken to vary: it
+// compresses at the wrong level on its first run, and the right one after.
+type varyingCompressor struct {
+	gzipCompressor
+	runs *int
+}
+
+func (varyingCompressor) Name() string {
+	return "test-varying"
+}
+
+func (varyingCompressor) nondeterministic() bool {
+	return true
+}
+
+func (vc varyingCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	*vc.runs++
+	if *vc.runs == 1 {
+		return gzipCompressor{level: gzip.BestCompression}.NewWriter(w)
+	}
+	return vc.gzipCompressor.NewWriter(w)
+}
+
+func TestNondeterministicMismatchNotMemoized(t *testing.T) {
+	cs := newTestStorage(t)
+	varying := varyingCompressor{gzipCompressor{level: gzip.NoCompression, header: gzip.Header{OS: 255}}, new(int)}
+	cs.compressors = []Compressor{gzipCompressor{level: gzip.BestSpeed}, varying}
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.NoCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+	unreproducible := testMetric(t, "containerstorage_unreproducible_blobs_total", nil)
+
+	_, _, err := cs.getBlob(context.Background(), img.layers[0].Encoded())
+	assert.ErrorAs(t, err, &ErrUnreproducibleBlob{})
+	assert.Equal(t, unreproducible, testMetric(t, "containerstorage_unreproducible_blobs_total", nil))
+
+	// The blob is not remembered as unreproducible, so a later request
+	// tries again and reproduces it
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+	candidates := cs.memo.candidates(img.layers[0].Encoded(), cs.compressors)
+	if assert.Len(t, candidates, 1) {
+		assert.Equal(t, "test-varying", candidates[0].Name())
+	}
+}
+
+func TestCompressedBlobError(t *testing.T) {
+	failure := errors.New("layer diff failed")
+	getDiff := func() (io.ReadCloser, error) {
+		return io.NopCloser(io.MultiReader(
+			bytes.NewReader(testLayerTar(t, "hello", "Hello, World!")),
+			iotest.ErrReader(failure))), nil
+	}
+	r, err := compressedBlob(context.Background(), gzipCompressor{}, getDiff)()
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, failure)
+}
+
+func TestZstdBlobs(t *testing.T) {
+	cs := newTestStorage(t)
+	zstdLayer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Zstd)
+
+	buf := &bytes.Buffer{}
+	w, err := zstdChunkedCompressor{}.NewWriter(buf)
+	require.NoError(t, err)
+	_, err = w.Write(testLayerTar(t, "goodbye", "Goodbye, World!"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	chunkedLayer := buf.Bytes()
+
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, zstdLayer, chunkedLayer)
+
+	assert.Equal(t, zstdLayer, readTestBlob(t, cs, img.layers[0]))
+
+	// zstd:chunked output varies between runs, so the blob is reproduced
+	// only if the compressor happens to produce the same bytes again, but a
+	// mismatch is not remembered and later requests try again
+	unreproducible := testMetric(t, "containerstorage_unreproducible_blobs_total", nil)
+	_, _, err = cs.getBlob(context.Background(), img.layers[1].Encoded())
+	candidates := cs.memo.candidates(img.layers[1].Encoded(), cs.compressors)
+	if err != nil {
+		assert.ErrorAs(t, err, &ErrUnreproducibleBlob{})
+		assert.Equal(t, unreproducible, testMetric(t, "containerstorage_unreproducible_blobs_total", nil))
+		assert.NotEmpty(t, candidates)
+	} else if assert.Len(t, candidates, 1) {
+		assert.Equal(t, "zstd-chunked", candidates[0].Name())
+	}
+}
+
+func TestModTimes(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	d := &driver{store: cs}
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"},
+		compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip))
+	image, err := cs.store.Image(img.id)
+	require.NoError(t, err)
+	layer, err := cs.store.Layer(image.TopLayer)
+	require.NoError(t, err)
+
+	for path, expected := range map[string]time.Time{
+		"/docker/registry/v2/repositories":                                                                               image.Created,
+		"/docker/registry/v2/repositories/localhost/foo/_manifests":                                                      image.Created,
+		"/docker/registry/v2/repositories/localhost/foo/_manifests/tags/latest/current/link":                             image.Created,
+		"/docker/registry/v2/repositories/localhost/foo/_manifests/revisions/sha256/" + img.manifest.Encoded() + "/link": image.Created,
+		"/docker/registry/v2/repositories/localhost/foo/_layers/sha256/" + img.layers[0].Encoded() + "/link":             layer.Created,
+		"/docker/registry/v2/blobs/sha256/" + img.config.Encoded()[:2] + "/" + img.config.Encoded() + "/data":            image.Created,
+		"/docker/registry/v2/blobs/sha256/" + img.layers[0].Encoded()[:2] + "/" + img.layers[0].Encoded():                layer.Created,
+	} {
+		fi, err := d.Stat(ctx, path)
+		if assert.NoError(t, err, path) {
+			assert.True(t, expected.Equal(fi.ModTime()), "%s: %v != %v", path, expected, fi.ModTime())
+		}
+	}
+
+	fi, err := d.Stat(ctx, "/docker/registry/v2/repositories/localhost/foo/_manifests/tags/latest/current/link")
+	require.NoError(t, err)
+	content, err := d.GetContent(ctx, fi.Path())
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), fi.Size())
+}
+
+func TestLinksCrossRepository(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	d := &driver{store: cs}
+	foo := addTestImage(t, cs, []string{"localhost/foo:latest"},
+		compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip))
+	bar := addTestImage(t, cs, []string{"localhost/bar:latest"},
+		compressTestLayer(t, testLayerTar(t, "goodbye", "Goodbye, World!"), archive.Gzip))
+
+	for repo, img := range map[string]testImage{"foo": foo, "bar": bar} {
+		prefix := "/docker/registry/v2/repositories/localhost/" + repo
+		for _, path := range []string{
+			prefix + "/_layers/sha256/" + img.layers[0].Encoded() + "/link",
+			prefix + "/_layers/sha256/" + img.config.Encoded() + "/link",
+			prefix + "/_manifests/revisions/sha256/" + img.manifest.Encoded() + "/link",
+		} {
+			_, err := d.Stat(ctx, path)
+			assert.NoError(t, err, path)
+		}
+	}
+
+	// Content of one repository cannot be reached through another
+	prefix := "/docker/registry/v2/repositories/localhost/bar"
+	for _, path := range []string{
+		prefix + "/_layers/sha256/" + foo.layers[0].Encoded() + "/link",
+		prefix + "/_layers/sha256/" + foo.config.Encoded() + "/link",
+		prefix + "/_manifests/revisions/sha256/" + foo.manifest.Encoded() + "/link",
+		"/docker/registry/v2/repositories/localhost/baz/_layers/sha256/" + foo.layers[0].Encoded() + "/link",
+	} {
+		_, err := d.Stat(ctx, path)
+		assert.ErrorAs(t, err, &storagedriver.PathNotFoundError{}, path)
+		_, err = d.GetContent(ctx, path)
+		assert.ErrorAs(t, err, &storagedriver.PathNotFoundError{}, path)
+	}
+
+	repo := newTestRepository(t, d, "localhost/bar")
+	_, err := repo.Blobs(ctx).Stat(ctx, foo.layers[0])
+	assert.ErrorIs(t, err, distribution.ErrBlobUnknown)
+	ms, err := repo.Manifests(ctx)
+	require.NoError(t, err)
+	exists, err := ms.Exists(ctx, foo.manifest)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// countingCompressor compresses with the stdlib gzip library, counting the
+// blobs it compresses and the greatest number it compresses at once.
+type countingCompressor struct {
+	gzipCompressor
+	lock    sync.Mutex
+	active  int
+	maxSeen int
+	total   int
+}
+
+var testCountingCompressor = &countingCompressor{
+	gzipCompressor: gzipCompressor{impl: stdlibGzip, level: gzip.DefaultCompression, header: gzip.Header{OS: 255}},
+}
+
+func init() {
+	RegisterCompressor(testCountingCompressor)
+}
+
+func (cc *countingCompressor) Name() string {
+	return "test-counting"
+}
+
+func (cc *countingCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw, err := cc.gzipCompressor.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.active++
+	cc.total++
+	cc.maxSeen = max(cc.maxSeen, cc.active)
+	return &countingWriter{zw, cc}, nil
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	cc *countingCompressor
+}
+
+func (cw *countingWriter) Close() error {
+	// Give other compressions a chance to overlap with this one
+	time.Sleep(10 * time.Millisecond)
+	cw.cc.lock.Lock()
+	cw.cc.active--
+	cw.cc.lock.Unlock()
+	return cw.WriteCloser.Close()
+}
+
+func TestConcurrentReproduction(t *testing.T) {
+	cs := newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions":   []interface{}{},
+		"compressors":     []interface{}{"test-counting"},
+		"maxcompressions": 2,
+		"cachedir":        t.TempDir(),
+	})
+	testCountingCompressor.lock.Lock()
+	testCountingCompressor.maxSeen, testCountingCompressor.total = 0, 0
+	testCountingCompressor.lock.Unlock()
+	blobs := [][]byte{}
+	for i := 0; i < 4; i++ {
+		layerTar := testLayerTar(t, fmt.Sprintf("file%d", i), fmt.Sprintf("Hello, World %d!", i))
+		blobs = append(blobs, gzipTestLayer(t, layerTar, gzip.DefaultCompression))
+	}
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, blobs...)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*len(blobs); i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			assert.Equal(t, blobs[n%len(blobs)], readTestBlob(t, cs, img.layers[n%len(blobs)]))
+		}(i)
+	}
+	wg.Wait()
+
+	// Each blob is compressed once, and no more than two at a time
+	testCountingCompressor.lock.Lock()
+	defer testCountingCompressor.lock.Unlock()
+	assert.Equal(t, len(blobs), testCountingCompressor.total)
+	assert.LessOrEqual(t, testCountingCompressor.maxSeen, 2)
+}
+
+// barrierCompressor waits in NewWriter until the given number of blobs are
+// being compressed at once.
+type barrierCompressor struct {
+	gzipCompressor
+	lock    sync.Mutex
+	arrived int
+	parties int
+	release chan struct{}
+}
+
+var testBarrierCompressor = &barrierCompressor{
+	gzipCompressor: gzipCompressor{impl: stdlibGzip, level: gzip.DefaultCompression, header: gzip.Header{OS: 255}},
+}
+
+func init() {
+	RegisterCompressor(testBarrierCompressor)
+}
+
+func (bc *barrierCompressor) Name() string {
+	return "test-barrier"
+}
+
+func (bc *barrierCompressor) reset(parties int) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.arrived, bc.parties, bc.release = 0, parties, make(chan struct{})
+}
+
+func (bc *barrierCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	bc.lock.Lock()
+	bc.arrived++
+	if bc.arrived == bc.parties {
+		close(bc.release)
+	}
+	release := bc.release
+	bc.lock.Unlock()
+	select {
+	case <-release:
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("compressions did not overlap")
+	}
+	return bc.gzipCompressor.NewWriter(w)
+}
+
+func TestConcurrentReproductionWithoutCache(t *testing.T) {
+	cs := newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions":   []interface{}{},
+		"compressors":     []interface{}{"test-barrier"},
+		"maxcompressions": 2,
+	})
+	testBarrierCompressor.reset(2)
+	blobs := [][]byte{}
+	for i := 0; i < 2; i++ {
+		layerTar := testLayerTar(t, fmt.Sprintf("file%d", i), fmt.Sprintf("Hello, World %d!", i))
+		blobs = append(blobs, gzipTestLayer(t, layerTar, gzip.DefaultCompression))
+	}
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, blobs...)
+
+	// Different blobs are reproduced at the same time, or the compressor
+	// would time out waiting for the other one
+	var wg sync.WaitGroup
+	for i := range blobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, blobs[i], readTestBlob(t, cs, img.layers[i]))
+		}()
+	}
+	wg.Wait()
+}
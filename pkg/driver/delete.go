@@ -0,0 +1,214 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containers/storage"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+// repoNames returns those of an image's names in the given repository that
+// match a filter.
+func (cs *containerStorage) repoNames(idx *storeIndex, image *storage.Image, repo string, match func(imageName) bool) []string {
+	names := []string{}
+	for _, n := range image.Names {
+		in, err := parseImageName(n, cs.hostPrefix)
+		if err == nil && in.repo == repo && !idx.hidden(in) && match(in) {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// deleteTag removes a tag from the image it names.
+func (cs *containerStorage) deleteTag(ctx context.Context, repo, tag string) (err error) {
+	ctx, span := cs.startSpan(ctx, "deleteTag", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	idx, err := cs.index(ctx)
+	if err != nil {
+		return err
+	}
+	if ri, ok := idx.repos[repo]; ok {
+		for _, image := range ri.images {
+			names := cs.repoNames(idx, image, repo, func(in imageName) bool {
+				return in.tag == tag
+			})
+			if len(names) > 0 {
+				return cs.store.RemoveNames(image.ID, names)
+			}
+		}
+	}
+	return fmt.Errorf("tag %s in repository %s %w", tag, repo, errNotFound)
+}
+
+// deleteManifest removes a manifest from a repository by removing the names
+// of the images with that manifest in the repository, including tags that
+// refer to it. Images left with no names are removed from the store, unless
+// they are in use by a container.
+func (cs *containerStorage) deleteManifest(ctx context.Context, repo, sha string) (err error) {
+	ctx, span := cs.startSpan(ctx, "deleteManifest", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	d := digest.NewDigestFromEncoded(digest.Canonical, sha)
+	idx, err := cs.index(ctx)
+	if err != nil {
+		return err
+	}
+	images, err := cs.store.ImagesByDigest(d)
+	if err != nil {
+		return err
+	}
+	containers, err := cs.store.Containers()
+	if err != nil {
+		return err
+	}
+
+	type removal struct {
+		image *storage.Image
+		names []string
+	}
+	removals := []removal{}
+	for _, image := range images {
+		names := cs.repoNames(idx, image, repo, func(in imageName) bool {
+			return in.digest == d || in.tag != "" && cs.tagDigest(ctx, image) == d
+		})
+		if len(names) == 0 {
+			continue
+		}
+		if len(names) == len(image.Names) {
+			for _, c := range containers {
+				if c.ImageID == image.ID {
+					return fmt.Errorf("image %s is in use by container %s", image.ID, c.ID)
+				}
+			}
+		}
+		removals = append(removals, removal{image, names})
+	}
+	if len(removals) == 0 {
+		return fmt.Errorf("manifest %s in repository %s %w", d, repo, errNotFound)
+	}
+
+	for _, r := range removals {
+		logger := dcontext.GetLoggerWithField(ctx, "image", r.image.ID)
+		var err error
+		if len(r.names) < len(r.image.Names) {
+			logger.Infof("containerstorage: removing names %v", r.names)
+			err = cs.store.RemoveNames(r.image.ID, r.names)
+		} else {
+			logger.Info("containerstorage: deleting image")
+			_, err = cs.store.DeleteImage(r.image.ID, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteLayerLink removes a blob that has been pushed to a repository but
+// is not yet used by any image in it. Blobs belonging to images cannot be
+// removed separately.
+func (cs *containerStorage) deleteLayerLink(ctx context.Context, repo, sha string) (err error) {
+	ctx, span := cs.startSpan(ctx, "deleteLayerLink", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	err = os.Remove(filepath.Join(cs.stagedLinkDir(repo), sha))
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	layers, err := cs.listRepoLayers(ctx, repo)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(layers, sha) {
+		return fmt.Errorf("blob %s is used by an image in repository %s", sha, repo)
+	}
+	return fmt.Errorf("blob %s in repository %s %w", sha, repo, errNotFound)
+}
+
+// deleteBlob removes a staged blob that is not yet used by any image. Blobs
+// in the container store are never removed here, since a layer that no image
+// uses yet may belong to a pull that is still in progress: deleting a blob
+// that an image or layer still references is an error, and deleting one that
+// nothing references does nothing. Blobs are removed from the store only
+// along with the last image that uses them.
+func (cs *containerStorage) deleteBlob(ctx context.Context, sha string) (err error) {
+	ctx, span := cs.startSpan(ctx, "deleteBlob", attrDigest.String(sha))
+	defer endSpan(span, &err)
+	d := digest.NewDigestFromEncoded(digest.Canonical, sha)
+	if _, _, ok := cs.staged.get(d); ok {
+		cs.staged.remove(d)
+		return nil
+	}
+
+	layers, err := cs.layersByDigest(d)
+	if err != nil {
+		return err
+	}
+	if len(layers) == 0 {
+		// Manifests and configs are removed along with their images
+		blobs, err := cs.listBlobs(ctx, sha)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(blobs, sha) {
+			return fmt.Errorf("blob %s %w", sha, errNotFound)
+		}
+		return fmt.Errorf("blob %s is used by an image", sha)
+	}
+
+	all, err := cs.store.Layers()
+	if err != nil {
+		return err
+	}
+	images, err := cs.store.Images()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		if layerInUse(l.ID, all, images) {
+			return fmt.Errorf("blob %s is used by layer %s", sha, l.ID)
+		}
+	}
+	dcontext.GetLoggerWithField(ctx, "digest", d).Debug("containerstorage: not deleting unused layer blob")
+	return nil
+}
+
+// layersByDigest returns the layers whose compressed or uncompressed digest
+// is the given one.
+func (cs *containerStorage) layersByDigest(d digest.Digest) ([]storage.Layer, error) {
+	layers, err := cs.store.LayersByCompressedDigest(d)
+	if err != nil && !errors.Is(err, storage.ErrLayerUnknown) {
+		return nil, err
+	}
+	uncompressed, err := cs.store.LayersByUncompressedDigest(d)
+	if err != nil && !errors.Is(err, storage.ErrLayerUnknown) {
+		return nil, err
+	}
+	for _, l := range uncompressed {
+		if !slices.ContainsFunc(layers, func(c storage.Layer) bool { return c.ID == l.ID }) {
+			layers = append(layers, l)
+		}
+	}
+	return layers, nil
+}
+
+// layerInUse returns whether a layer is the top layer of any image, or the
+// parent of any other layer (including container layers).
+func layerInUse(id string, layers []storage.Layer, images []storage.Image) bool {
+	for _, l := range layers {
+		if l.Parent == id {
+			return true
+		}
+	}
+	for _, image := range images {
+		if image.TopLayer == id || slices.Contains(image.MappedTopLayers, id) {
+			return true
+		}
+	}
+	return false
+}
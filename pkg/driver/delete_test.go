@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/distribution/distribution/v3"
+	registrystorage "github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteNotAllowed(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	d := &driver{store: cs}
+	repo := newTestRepository(t, d, "localhost/foo")
+	pushed := pushTestImage(t, repo, "latest", "Hello, World!")
+
+	err := d.Delete(ctx, "/docker/registry/v2/repositories/localhost/foo/_manifests/tags/latest")
+	assert.ErrorAs(t, err, &storagedriver.ErrUnsupportedMethod{})
+	_, err = cs.store.Image(pushed.config.Digest.Encoded())
+	assert.NoError(t, err)
+}
+
+func TestDeleteTag(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	repo := newTestRepository(t, &driver{store: cs, allowDelete: true}, "localhost/foo",
+		registrystorage.EnableDelete)
+	pushed := pushTestImage(t, repo, "latest", "Hello, World!")
+	require.NoError(t, repo.Tags(ctx).Tag(ctx, "stable", distribution.Descriptor{Digest: pushed.digest}))
+
+	require.NoError(t, repo.Tags(ctx).Untag(ctx, "latest"))
+	image, err := cs.store.Image(pushed.config.Digest.Encoded())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"localhost/foo:stable",
+		"localhost/foo@" + pushed.digest.String(),
+	}, image.Names)
+
+	err = repo.Tags(ctx).Untag(ctx, "latest")
+	assert.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+}
+
+func TestDeleteManifest(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	repo := newTestRepository(t, &driver{store: cs, allowDelete: true}, "localhost/foo",
+		registrystorage.EnableDelete)
+	pushed := pushTestImage(t, repo, "latest", "Hello, World!")
+	other := pushTestImage(t, repo, "other", "Goodbye, World!")
+
+	ms, err := repo.Manifests(ctx)
+	require.NoError(t, err)
+	require.NoError(t, ms.Delete(ctx, pushed.digest))
+	_, err = cs.store.Image(pushed.config.Digest.Encoded())
+	assert.ErrorIs(t, err, storage.ErrImageUnknown)
+	tags, err := cs.listRepoTags(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"other": other.digest.Encoded()}, tags)
+
+	// The image's layers are removed along with it
+	assert.False(t, cs.hasLayer(pushed.layer.Digest))
+	assert.ErrorIs(t, cs.deleteBlob(context.Background(), pushed.layer.Digest.Encoded()), errNotFound)
+
+	// Images in use by containers are not removed
+	_, err = cs.store.CreateContainer("", nil, other.config.Digest.Encoded(), "", "", nil)
+	require.NoError(t, err)
+	assert.Error(t, ms.Delete(ctx, other.digest))
+	_, err = cs.store.Image(other.config.Digest.Encoded())
+	assert.NoError(t, err)
+	// Nor are their layers, which cannot be deleted while in use
+	assert.Error(t, cs.deleteBlob(context.Background(), other.layer.Digest.Encoded()))
+	assert.True(t, cs.hasLayer(other.layer.Digest))
+}
+
+func TestDeleteBlobKeepsUnusedLayer(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	d := &driver{store: cs, allowDelete: true}
+
+	// A layer written for a pull that has not yet created its image
+	blob := compressTestLayer(t, testLayerTar(t, "pulling", "Not yet an image"), archive.Gzip)
+	layer, _, err := cs.store.PutLayer("", "", nil, "", false, nil, bytes.NewReader(blob))
+	require.NoError(t, err)
+
+	require.NoError(t, d.Delete(ctx, "/docker/registry/v2/blobs/sha256/"+layer.CompressedDigest.Encoded()[:2]+"/"+layer.CompressedDigest.Encoded()))
+	_, err = cs.store.Layer(layer.ID)
+	assert.NoError(t, err)
+}
+
+func TestDeleteStagedBlob(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	repo := newTestRepository(t, &driver{store: cs, allowDelete: true}, "localhost/foo",
+		registrystorage.EnableDelete)
+	desc := pushTestBlob(t, repo, "application/octet-stream", []byte("Hello, World!"))
+
+	require.NoError(t, repo.Blobs(ctx).Delete(ctx, desc.Digest))
+	layers, err := cs.listRepoLayers(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.NotContains(t, layers, desc.Digest.Encoded())
+
+	require.NoError(t, cs.deleteBlob(context.Background(), desc.Digest.Encoded()))
+	_, _, err = cs.getBlob(context.Background(), desc.Digest.Encoded())
+	assert.ErrorIs(t, err, errNotFound)
+}
@@ -0,0 +1,364 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/lockfile"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/docker/go-metrics"
+	"github.com/opencontainers/go-digest"
+)
+
+// storeIndex is a snapshot of the images and layers in the container store,
+// arranged for the lookups made when serving the registry's directory tree.
+// It must not be modified once built.
+type storeIndex struct {
+	images []storage.Image
+	layers map[string]*storage.Layer
+	repos  map[string]*repoIndex
+	blobs  *shaSet
+	// prefixes holds the blobs in blobs, keyed by the first two characters
+	// of their digest as in the registry's blob directories.
+	prefixes map[string][]string
+	// bigData holds the images that store each blob (such as a config) in
+	// their big data.
+	bigData map[digest.Digest][]*storage.Image
+	// unknown holds the images that have layers for which no compressed
+	// digest is recorded.
+	unknown []*storage.Image
+	// created holds the time at which each blob was first added to the
+	// store, as recorded when the layer or image containing it was created.
+	created map[string]time.Time
+	// modTime is the time at which the most recent image or layer was
+	// created.
+	modTime time.Time
+	// hosts holds the host whose images are served in each repository to
+	// which images from several hosts are mapped.
+	hosts map[string]string
+}
+
+// repoIndex holds the images in a repository and the blobs they use.
+type repoIndex struct {
+	images    []*storage.Image
+	revisions *shaSet
+	layers    *shaSet
+	// modTime is the time at which the most recent image was created.
+	modTime time.Time
+}
+
+// addCreated records that the blobs in shas were added to the store at the
+// given time, unless they were added earlier.
+func (idx *storeIndex) addCreated(shas []string, created time.Time) {
+	for _, sha := range shas {
+		if t, ok := idx.created[sha]; !ok || created.Before(t) {
+			idx.created[sha] = created
+		}
+	}
+	if created.After(idx.modTime) {
+		idx.modTime = created
+	}
+}
+
+// hidden returns whether an image name is ignored because images from
+// another host are served in its repository.
+func (idx *storeIndex) hidden(in imageName) bool {
+	host, ok := idx.hosts[in.repo]
+	return ok && host != in.host
+}
+
+// blobsWithPrefix returns the blobs whose digests begin with the given
+// prefix.
+func (idx *storeIndex) blobsWithPrefix(prefix string) []string {
+	candidates := idx.blobs.list()
+	if len(prefix) >= 2 {
+		candidates = idx.prefixes[prefix[:2]]
+	}
+	blobs := []string{}
+	for _, sha := range candidates {
+		if strings.HasPrefix(sha, prefix) {
+			blobs = append(blobs, sha)
+		}
+	}
+	return blobs
+}
+
+// buildIndex enumerates the container store. The previous index, if any, is
+// used to report only changes in which hosts' images are served where their
+// names collide.
+func (cs *containerStorage) buildIndex(ctx context.Context, prev *storeIndex) (_ *storeIndex, err error) {
+	ctx, span := cs.startSpan(ctx, "buildIndex")
+	defer endSpan(span, &err)
+	defer metrics.StartTimer(indexTimer)()
+	images, err := cs.store.Images()
+	if err != nil {
+		return nil, err
+	}
+	span.AddEvent("listed images")
+	layers, err := cs.store.Layers()
+	if err != nil {
+		return nil, err
+	}
+	span.AddEvent("listed layers")
+	idx := &storeIndex{
+		images:   images,
+		layers:   make(map[string]*storage.Layer, len(layers)),
+		repos:    map[string]*repoIndex{},
+		blobs:    newShaSet(),
+		prefixes: map[string][]string{},
+		bigData:  map[digest.Digest][]*storage.Image{},
+		created:  map[string]time.Time{},
+		hosts:    cs.strippedHosts(images),
+	}
+	for repo, host := range idx.hosts {
+		if prev != nil && prev.hosts[repo] == host {
+			continue
+		}
+		dcontext.GetLoggerWithField(ctx, "repository", repo).Warnf("containerstorage: images from several hosts map to the same repository; serving only those from %s", host)
+	}
+	for i := range layers {
+		idx.layers[layers[i].ID] = &layers[i]
+		layerBlobs := newShaSet()
+		layerBlobs.add(layers[i].CompressedDigest)
+		layerBlobs.add(layers[i].UncompressedDigest)
+		idx.blobs.merge(layerBlobs)
+		idx.addCreated(layerBlobs.list(), layers[i].Created)
+	}
+
+	for i := range images {
+		image := &images[i]
+		imageBlobs := newShaSet()
+		for _, d := range bigDataBlobs(image) {
+			imageBlobs.add(d)
+			idx.bigData[d] = append(idx.bigData[d], image)
+		}
+		unknownBlobs := false
+		for l := idx.layers[image.TopLayer]; l != nil; l = idx.layers[l.Parent] {
+			imageBlobs.add(l.CompressedDigest)
+			imageBlobs.add(l.UncompressedDigest)
+			unknownBlobs = unknownBlobs || l.CompressedDigest == ""
+		}
+		if unknownBlobs {
+			idx.unknown = append(idx.unknown, image)
+			cs.addManifestLayers(imageBlobs, image)
+		}
+
+		revisions := newShaSet()
+		for _, d := range image.Digests {
+			revisions.add(d)
+		}
+		for d := range manifestBigData(image) {
+			revisions.add(d)
+		}
+		idx.blobs.merge(revisions)
+		idx.blobs.merge(imageBlobs)
+		idx.addCreated(revisions.list(), image.Created)
+		idx.addCreated(imageBlobs.list(), image.Created)
+
+		for _, in := range cs.imageNames(idx, image) {
+			ri, ok := idx.repos[in.repo]
+			if !ok {
+				ri = &repoIndex{revisions: newShaSet(), layers: newShaSet()}
+				idx.repos[in.repo] = ri
+			}
+			if len(ri.images) > 0 && ri.images[len(ri.images)-1] == image {
+				continue
+			}
+			ri.images = append(ri.images, image)
+			ri.revisions.merge(revisions)
+			ri.layers.merge(imageBlobs)
+			if image.Created.After(ri.modTime) {
+				ri.modTime = image.Created
+			}
+		}
+	}
+
+	for _, sha := range idx.blobs.list() {
+		idx.prefixes[sha[:2]] = append(idx.prefixes[sha[:2]], sha)
+	}
+	return idx, nil
+}
+
+// storeIndexCache holds the most recent index of the container store. The
+// index is rebuilt only when the store's lock files record that the images
+// or layers have been written since it was built, whether by this process
+// or by another one (such as podman) sharing the store.
+type storeIndexCache struct {
+	lock       sync.Mutex
+	lockFiles  []*lockfile.LockFile
+	lastWrites []lockfile.LastWrite
+	index      *storeIndex
+}
+
+// newStoreIndexCache opens the lock files of the image and layer stores
+// kept in the given directory by the graph driver, and in any additional
+// image stores.
+func newStoreIndexCache(storeDir, driverName string, additionalImageStores []string) (*storeIndexCache, error) {
+	ic := &storeIndexCache{}
+	for _, path := range []string{
+		filepath.Join(storeDir, driverName+"-images", "images.lock"),
+		filepath.Join(storeDir, driverName+"-layers", "layers.lock"),
+	} {
+		lf, err := lockfile.GetLockFile(path)
+		if err != nil {
+			return nil, err
+		}
+		ic.lockFiles = append(ic.lockFiles, lf)
+	}
+	for _, dir := range additionalImageStores {
+		for _, path := range []string{
+			filepath.Join(dir, driverName+"-images", "images.lock"),
+			filepath.Join(dir, driverName+"-layers", "layers.lock"),
+		} {
+			lf, err := lockfile.GetROLockFile(path)
+			if err != nil {
+				return nil, err
+			}
+			ic.lockFiles = append(ic.lockFiles, lf)
+		}
+	}
+	return ic, nil
+}
+
+// modified returns whether any of the lock files has been written since the
+// index was built, along with the values to record once it is rebuilt.
+func (ic *storeIndexCache) modified() ([]lockfile.LastWrite, bool, error) {
+	lastWrites := make([]lockfile.LastWrite, len(ic.lockFiles))
+	modified := ic.index == nil
+	for i, lf := range ic.lockFiles {
+		var lw lockfile.LastWrite
+		var m bool
+		var err error
+		lf.RLock()
+		if ic.index == nil {
+			lw, err = lf.GetLastWrite()
+		} else {
+			lw, m, err = lf.ModifiedSince(ic.lastWrites[i])
+		}
+		lf.Unlock()
+		if err != nil {
+			return nil, false, err
+		}
+		lastWrites[i] = lw
+		modified = modified || m
+	}
+	return lastWrites, modified, nil
+}
+
+// update rebuilds the index if the store has changed. It returns the
+// current index and, if it was replaced, the previous one.
+func (ic *storeIndexCache) update(build func(prev *storeIndex) (*storeIndex, error)) (*storeIndex, *storeIndex, error) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	lastWrites, modified, err := ic.modified()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !modified {
+		return ic.index, nil, nil
+	}
+	// Any write made while the index is being built changes the lock
+	// files again, so it will be picked up by the next rebuild.
+	idx, err := build(ic.index)
+	if err != nil {
+		return nil, nil, err
+	}
+	old := ic.index
+	ic.index, ic.lastWrites = idx, lastWrites
+	return idx, old, nil
+}
+
+// index returns an up-to-date index of the container store.
+func (cs *containerStorage) index(ctx context.Context) (*storeIndex, error) {
+	idx, old, err := cs.indexCache.update(func(prev *storeIndex) (*storeIndex, error) {
+		return cs.buildIndex(ctx, prev)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		cs.pruneCaches(old, idx)
+	}
+	return idx, nil
+}
+
+// pruneCaches discards cached information about the images and blobs that
+// were in the old index of the container store but are not in the new one.
+func (cs *containerStorage) pruneCaches(old, idx *storeIndex) {
+	imageIDs := make(map[string]struct{}, len(idx.images))
+	for i := range idx.images {
+		imageIDs[idx.images[i].ID] = struct{}{}
+	}
+	cs.synthesized.prune(func(id string) bool {
+		_, ok := imageIDs[id]
+		return ok
+	})
+	cs.memo.prune(idx.blobs.contains)
+	for _, sha := range old.blobs.list() {
+		if !idx.blobs.contains(sha) {
+			d := digest.NewDigestFromEncoded(digest.Canonical, sha)
+			// The spool may be shared with other stores of a
+			// union that still have the layer
+			if cs.union == nil || !cs.union.hasLayer(d) {
+				cs.cache.remove(d)
+			}
+			cs.pushed.remove(d)
+		}
+	}
+}
+
+// watch checks the container store for changes at the given interval until
+// the driver is closed, so that the index is kept up to date and stale
+// cache entries are discarded even while no requests are being made. A
+// failure to check is logged when it first occurs, rather than at every
+// interval.
+func (cs *containerStorage) watch(interval time.Duration) {
+	defer cs.watching.Done()
+	ctx := context.Background()
+	logger := dcontext.GetLogger(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastErr := ""
+	for {
+		select {
+		case <-cs.done:
+			return
+		case <-ticker.C:
+			_, err := cs.index(ctx)
+			switch {
+			case err != nil && err.Error() != lastErr:
+				logger.Errorf("containerstorage: cannot check container store for changes: %v", err)
+				lastErr = err.Error()
+			case err == nil && lastErr != "":
+				logger.Info("containerstorage: container store can be checked for changes again")
+				lastErr = ""
+			}
+		}
+	}
+}
+
+// close stops watching the container store, waits for any check in
+// progress to finish, shuts down the store and removes its temporary
+// directories.
+func (cs *containerStorage) close() error {
+	cs.closeOnce.Do(func() {
+		close(cs.done)
+		cs.watching.Wait()
+		for _, dir := range cs.tempDirs {
+			os.RemoveAll(dir)
+		}
+		// Layers mounted by containers are left mounted for them, and
+		// the store's driver with them.
+		if _, err := cs.store.Shutdown(false); err != nil && !errors.Is(err, storage.ErrLayerUsedByContainer) {
+			cs.closeErr = fmt.Errorf("cannot shut down container store: %w", err)
+		}
+	})
+	return cs.closeErr
+}
@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexRebuiltOnChange(t *testing.T) {
+	cs := newTestStorage(t)
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	idx, err := cs.index(context.Background())
+	require.NoError(t, err)
+	again, err := cs.index(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, idx, again, "index should be reused while the store is unchanged")
+	assert.Contains(t, idx.repos, "localhost/foo")
+	assert.Equal(t, []string{img.manifest.Encoded()}, idx.repos["localhost/foo"].revisions.list())
+	assert.Equal(t, []string{img.layers[0].Encoded()}, idx.blobsWithPrefix(img.layers[0].Encoded()))
+
+	require.NoError(t, cs.store.AddNames(img.id, []string{"localhost/bar:latest"}))
+	idx, err = cs.index(context.Background())
+	require.NoError(t, err)
+	assert.NotSame(t, again, idx)
+	assert.Contains(t, idx.repos, "localhost/bar")
+
+	layer = compressTestLayer(t, testLayerTar(t, "goodbye", "Goodbye!"), archive.Gzip)
+	other := addTestImage(t, cs, []string{"localhost/baz:latest"}, layer)
+	repos, err := cs.listRepos(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"localhost/foo", "localhost/bar", "localhost/baz"}, repos)
+	blobs, err := cs.listBlobs(context.Background(), other.layers[0].Encoded())
+	require.NoError(t, err)
+	assert.Equal(t, []string{other.layers[0].Encoded()}, blobs)
+}
+
+func TestIndexStripHostCollision(t *testing.T) {
+	cs := newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions": []interface{}{},
+		"hostprefix":    "strip",
+	})
+	addTestImage(t, cs, []string{"quay.io/library/foo:quay"},
+		compressTestLayer(t, testLayerTar(t, "quay", "From Quay"), archive.Gzip))
+	docker := addTestImage(t, cs, []string{"docker.io/library/foo:docker", "quay.io/library/foo:both"},
+		compressTestLayer(t, testLayerTar(t, "docker", "From Docker Hub"), archive.Gzip))
+
+	// The first host in alphabetical order is served
+	tags, err := cs.listRepoTags(context.Background(), "library/foo")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"docker": docker.manifest.Encoded()}, tags)
+	revisions, err := cs.listRepoRevisions(context.Background(), "library/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{docker.manifest.Encoded()}, revisions)
+
+	// Images pushed to the registry are stored under localhost, which
+	// takes precedence
+	local := addTestImage(t, cs, []string{"localhost/library/foo:local"},
+		compressTestLayer(t, testLayerTar(t, "local", "Pushed"), archive.Gzip))
+	tags, err = cs.listRepoTags(context.Background(), "library/foo")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"local": local.manifest.Encoded()}, tags)
+}
+
+func TestIndexStripHostCollisionWarnedOnce(t *testing.T) {
+	// Without watching, the index is built only with the test's logger
+	cs := newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions": []interface{}{},
+		"hostprefix":    "strip",
+		"watchinterval": 0,
+	})
+	addTestImage(t, cs, []string{"quay.io/library/foo:quay", "docker.io/library/foo:docker"},
+		compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip))
+	logger, hook := logtest.NewNullLogger()
+	ctx := dcontext.WithLogger(context.Background(), logrus.NewEntry(logger))
+
+	_, err := cs.index(ctx)
+	require.NoError(t, err)
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, "library/foo", hook.LastEntry().Data["repository"])
+
+	// Rebuilding the index for an unrelated change does not warn again
+	addTestImage(t, cs, []string{"localhost/bar:latest"},
+		compressTestLayer(t, testLayerTar(t, "bar", "Bar"), archive.Gzip))
+	_, err = cs.index(ctx)
+	require.NoError(t, err)
+	assert.Len(t, hook.AllEntries(), 1)
+
+	// It does when the host served changes
+	addTestImage(t, cs, []string{"localhost/library/foo:local"},
+		compressTestLayer(t, testLayerTar(t, "local", "Pushed"), archive.Gzip))
+	_, err = cs.index(ctx)
+	require.NoError(t, err)
+	assert.Len(t, hook.AllEntries(), 2)
+}
+
+func TestIndexPrunesCaches(t *testing.T) {
+	cs := newTestStorage(t)
+	cs.synthesize = true
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+	otherLayer := compressTestLayer(t, testLayerTar(t, "other", "Other"), archive.Gzip)
+	other := addTestImage(t, cs, []string{"localhost/bar:latest"}, otherLayer)
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+	assert.Equal(t, otherLayer, readTestBlob(t, cs, other.layers[0]))
+	_, err := cs.listRepoTags(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+
+	_, _, ok := cs.cache.get(img.layers[0])
+	require.True(t, ok)
+	require.NotEmpty(t, cs.memo.candidates(img.layers[0].Encoded(), nil))
+	require.False(t, cs.synthesized.start(img.id), "image should have been queued")
+
+	// Remove the image as another process sharing the store would
+	_, err = cs.store.DeleteImage(img.id, true)
+	require.NoError(t, err)
+	_, err = cs.index(context.Background())
+	require.NoError(t, err)
+
+	_, _, ok = cs.cache.get(img.layers[0])
+	assert.False(t, ok)
+	assert.Empty(t, cs.memo.candidates(img.layers[0].Encoded(), nil))
+	assert.True(t, cs.synthesized.start(img.id), "image should be forgotten")
+	_, _, ok = cs.cache.get(other.layers[0])
+	assert.True(t, ok, "blobs still in the store should stay cached")
+	repos, err := cs.listRepos(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost/bar"}, repos)
+}
+
+func TestWatch(t *testing.T) {
+	cs := newTestStorage(t)
+	cs.watching.Add(1)
+	go cs.watch(10 * time.Millisecond)
+	_, err := cs.index(context.Background())
+	require.NoError(t, err)
+
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+	assert.Eventually(t, func() bool {
+		cs.indexCache.lock.Lock()
+		defer cs.indexCache.lock.Unlock()
+		_, ok := cs.indexCache.index.repos["localhost/foo"]
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+	_, err = cs.store.DeleteImage(img.id, true)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, _, ok := cs.cache.get(img.layers[0])
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
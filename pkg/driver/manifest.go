@@ -0,0 +1,104 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// zstdChunkedManifestKey is the layer big data key under which
+// containers/storage keeps the table of contents of a layer pulled from a
+// zstd:chunked blob.
+const zstdChunkedManifestKey = "zstd-chunked-manifest"
+
+// manifestLayer describes a layer blob referenced by an image manifest.
+type manifestLayer struct {
+	digest    digest.Digest
+	mediaType string
+	diffID    digest.Digest
+}
+
+// manifestLayers returns the layer blobs referenced by an image's manifest,
+// along with their uncompressed digests from the image config.
+func (cs *containerStorage) manifestLayers(image *storage.Image) ([]manifestLayer, error) {
+	b, err := cs.store.ImageBigData(image.ID, storage.ImageDigestBigDataKey)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Config struct {
+			Digest digest.Digest `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			MediaType string        `json:"mediaType"`
+			Digest    digest.Digest `json:"digest"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest of image %s: %w", image.ID, err)
+	}
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest of image %s has no config", image.ID)
+	}
+
+	b, err = cs.store.ImageBigData(image.ID, manifest.Config.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		RootFS struct {
+			DiffIDs []digest.Digest `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("cannot parse config of image %s: %w", image.ID, err)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image %s has %d layers but %d diff IDs",
+			image.ID, len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	layers := make([]manifestLayer, 0, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		layers = append(layers, manifestLayer{
+			digest:    l.Digest,
+			mediaType: l.MediaType,
+			diffID:    config.RootFS.DiffIDs[i],
+		})
+	}
+	return layers, nil
+}
+
+// mediaTypeCompression returns the compression format indicated by a layer
+// media type.
+func mediaTypeCompression(mediaType string) (archive.Compression, bool) {
+	switch {
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return archive.Zstd, true
+	case strings.HasSuffix(mediaType, "+gzip"),
+		strings.HasSuffix(mediaType, ".tar.gzip"):
+		return archive.Gzip, true
+	case strings.HasSuffix(mediaType, ".tar"):
+		return archive.Uncompressed, true
+	}
+	return archive.Uncompressed, false
+}
+
+// ociMediaType returns the OCI equivalent of a Docker schema 2 config or
+// layer media type, and other media types unchanged. Foreign layers become
+// ordinary ones, since the registry serves their blobs itself.
+func ociMediaType(mediaType string) string {
+	switch mediaType {
+	case schema2.MediaTypeImageConfig:
+		return v1.MediaTypeImageConfig
+	case schema2.MediaTypeLayer, schema2.MediaTypeForeignLayer:
+		return v1.MediaTypeImageLayerGzip
+	}
+	return mediaType
+}
@@ -0,0 +1,25 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMediaTypeCompression(t *testing.T) {
+	for mediaType, expected := range map[string]archive.Compression{
+		"application/vnd.oci.image.layer.v1.tar+gzip":               archive.Gzip,
+		"application/vnd.oci.image.layer.v1.tar+zstd":               archive.Zstd,
+		"application/vnd.oci.image.layer.v1.tar":                    archive.Uncompressed,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":         archive.Gzip,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": archive.Gzip,
+	} {
+		format, ok := mediaTypeCompression(mediaType)
+		assert.True(t, ok, mediaType)
+		assert.Equal(t, expected, format, mediaType)
+	}
+
+	_, ok := mediaTypeCompression("application/vnd.example.unknown")
+	assert.False(t, ok)
+}
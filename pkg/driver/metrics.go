@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"io"
+	"time"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/docker/go-metrics"
+)
+
+// The driver's metrics are added to the registry's storage namespace, which
+// the registry exports along with those of its other storage drivers.
+var (
+	// compressionCount counts the attempts to reproduce a layer blob, by
+	// compressor and by result: "reproduced", "mismatch", "unavailable" or
+	// "error".
+	compressionCount = prometheus.StorageNamespace.NewLabeledCounter("containerstorage_compressions", "The number of attempts to reproduce a layer blob", "compressor", "result")
+
+	compressionTimer = prometheus.StorageNamespace.NewLabeledTimer("containerstorage_compression", "The number of seconds taken to compress a layer", "compressor")
+
+	compressedBytes = prometheus.StorageNamespace.NewLabeledCounter("containerstorage_compressed_bytes", "The number of bytes of layer blobs compressed", "compressor")
+
+	unreproducibleCount = prometheus.StorageNamespace.NewCounter("containerstorage_unreproducible_blobs", "The number of layer blobs that could not be reproduced")
+
+	// cacheCount counts the lookups of layer blobs in the blob cache, by
+	// result: "Hit" or "Miss".
+	cacheCount = prometheus.StorageNamespace.NewLabeledCounter("containerstorage_cache", "The number of layer blob cache lookups", "type")
+
+	indexTimer = prometheus.StorageNamespace.NewTimer("containerstorage_index", "The number of seconds taken to list the images and layers in a container store")
+
+	firstByteTimer = prometheus.StorageNamespace.NewTimer("containerstorage_first_byte", "The number of seconds from a request for a blob until its first byte is read")
+)
+
+// meteredWriter counts the bytes written through it.
+type meteredWriter struct {
+	io.Writer
+	counter metrics.Counter
+}
+
+func (mw meteredWriter) Write(p []byte) (int, error) {
+	n, err := mw.Writer.Write(p)
+	mw.counter.Inc(float64(n))
+	return n, err
+}
+
+// newFirstByteReader returns a reader that records the time from start until
+// the first byte is read from r. The reader can seek if r can.
+func newFirstByteReader(r io.ReadCloser, start time.Time) io.ReadCloser {
+	fbr := &firstByteReader{ReadCloser: r, start: start}
+	if s, ok := r.(io.Seeker); ok {
+		return firstByteReadSeeker{fbr, s}
+	}
+	return fbr
+}
+
+type firstByteReadSeeker struct {
+	*firstByteReader
+	io.Seeker
+}
+
+type firstByteReader struct {
+	io.ReadCloser
+	start time.Time
+	read  bool
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.read {
+		r.read = true
+		firstByteTimer.UpdateSince(r.start)
+	}
+	return n, err
+}
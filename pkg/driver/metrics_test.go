@@ -0,0 +1,92 @@
+package driver
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMetric returns the value of a counter, or the number of observations
+// of a timer, with the given labels.
+func testMetric(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "registry_storage_"+name {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return float64(m.GetHistogram().GetSampleCount())
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	cs := newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions": []interface{}{},
+		"compressors":   []interface{}{"gzip-1", "gzip"},
+		"cachedir":      t.TempDir(),
+	})
+	d := &driver{store: cs}
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.DefaultCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+	path := "/docker/registry/v2/blobs/sha256/" + img.layers[0].Encoded()[:2] + "/" + img.layers[0].Encoded() + "/data"
+
+	mismatched := testMetric(t, "containerstorage_compressions_total", map[string]string{"compressor": "gzip-1", "result": "mismatch"})
+	reproduced := testMetric(t, "containerstorage_compressions_total", map[string]string{"compressor": "gzip", "result": "reproduced"})
+	compressed := testMetric(t, "containerstorage_compressed_bytes_total", map[string]string{"compressor": "gzip"})
+	hits := testMetric(t, "containerstorage_cache_total", map[string]string{"type": "Hit"})
+	misses := testMetric(t, "containerstorage_cache_total", map[string]string{"type": "Miss"})
+	firstBytes := testMetric(t, "containerstorage_first_byte_seconds", nil)
+
+	for i := 0; i < 2; i++ {
+		r, err := d.Reader(context.Background(), path, 0)
+		require.NoError(t, err)
+		b, err := io.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		assert.Equal(t, layer, b)
+	}
+
+	assert.Equal(t, mismatched+1, testMetric(t, "containerstorage_compressions_total", map[string]string{"compressor": "gzip-1", "result": "mismatch"}))
+	assert.Equal(t, reproduced+1, testMetric(t, "containerstorage_compressions_total", map[string]string{"compressor": "gzip", "result": "reproduced"}))
+	assert.Equal(t, compressed+float64(len(layer)), testMetric(t, "containerstorage_compressed_bytes_total", map[string]string{"compressor": "gzip"}))
+	assert.Equal(t, hits+1, testMetric(t, "containerstorage_cache_total", map[string]string{"type": "Hit"}))
+	assert.Equal(t, misses+1, testMetric(t, "containerstorage_cache_total", map[string]string{"type": "Miss"}))
+	assert.Equal(t, firstBytes+2, testMetric(t, "containerstorage_first_byte_seconds", nil))
+}
+
+func TestMetricsUnavailableCompressor(t *testing.T) {
+	cs := newTestStorage(t)
+	cs.compressors = []Compressor{unavailableCompressor{}}
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.DefaultCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	unreproducible := testMetric(t, "containerstorage_unreproducible_blobs_total", nil)
+	unavailable := testMetric(t, "containerstorage_compressions_total", map[string]string{"compressor": "test-unavailable", "result": "unavailable"})
+
+	for i := 0; i < 2; i++ {
+		_, _, err := cs.getBlob(context.Background(), img.layers[0].Encoded())
+		assert.ErrorAs(t, err, &ErrUnreproducibleBlob{})
+	}
+
+	// A blob that no compressor could try is not counted as unreproducible
+	assert.Equal(t, unreproducible, testMetric(t, "containerstorage_unreproducible_blobs_total", nil))
+	assert.Equal(t, unavailable+2, testMetric(t, "containerstorage_compressions_total", map[string]string{"compressor": "test-unavailable", "result": "unavailable"}))
+}
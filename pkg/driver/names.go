@@ -0,0 +1,178 @@
+package driver
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/containers/storage"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// hostPrefixMode determines how the registry host at the start of an image
+// name in containers-storage is mapped to a repository name.
+type hostPrefixMode string
+
+const (
+	// hostPrefixKeep uses the fully-qualified name, e.g.
+	// docker.io/library/nginx or localhost/foo.
+	hostPrefixKeep hostPrefixMode = "keep"
+	// hostPrefixStrip removes the host, e.g. library/nginx or foo.
+	hostPrefixStrip hostPrefixMode = "strip"
+	// hostPrefixFamiliar uses the familiar Docker name, e.g. nginx for
+	// docker.io/library/nginx, while keeping other hosts, e.g. localhost/foo.
+	hostPrefixFamiliar hostPrefixMode = "familiar"
+)
+
+func parseHostPrefixMode(mode string) (hostPrefixMode, error) {
+	switch m := hostPrefixMode(mode); m {
+	case "":
+		return hostPrefixKeep, nil
+	case hostPrefixKeep, hostPrefixStrip, hostPrefixFamiliar:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid host prefix mode %q, must be one of %q, %q or %q",
+		mode, hostPrefixKeep, hostPrefixStrip, hostPrefixFamiliar)
+}
+
+// imageName is an image name from containers-storage split into its
+// registry repository name and tag or digest.
+type imageName struct {
+	host   string
+	repo   string
+	tag    string
+	digest digest.Digest
+}
+
+// repoHost returns the form of a registry host used in repository names.
+// A colon may not appear in a repository name, so the one before a port is
+// replaced with an underscore, e.g. localhost_5000 for localhost:5000. An
+// underscore cannot appear in a host, nor in a Docker Hub namespace, so the
+// two cannot be confused.
+func repoHost(host string) string {
+	return strings.Replace(host, ":", "_", 1)
+}
+
+// storageHost reverses repoHost for the first component of a repository
+// name, if it names a host with a port.
+func storageHost(component string) (string, bool) {
+	i := strings.LastIndex(component, "_")
+	if i <= 0 || i == len(component)-1 {
+		return "", false
+	}
+	for _, c := range component[i+1:] {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return component[:i] + ":" + component[i+1:], true
+}
+
+// parseImageName parses a containers-storage image name such as
+// "docker.io/library/nginx:latest" or "quay.io/foo/bar@sha256:..." into a
+// repository name (according to mode) and a tag and/or digest.
+func parseImageName(name string, mode hostPrefixMode) (imageName, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return imageName{}, err
+	}
+	in := imageName{host: reference.Domain(named)}
+	switch mode {
+	case hostPrefixStrip:
+		in.repo = reference.Path(named)
+	case hostPrefixFamiliar:
+		in.repo = reference.FamiliarName(named)
+	default:
+		in.repo = named.Name()
+	}
+	if rest, ok := strings.CutPrefix(in.repo, in.host+"/"); ok {
+		in.repo = repoHost(in.host) + "/" + rest
+	}
+	if _, err := reference.WithName(in.repo); err != nil {
+		return imageName{}, fmt.Errorf("image %s has no repository name in host prefix mode %q: %w", name, mode, err)
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		in.tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		in.digest = digested.Digest()
+	}
+	return in, nil
+}
+
+// imageNames returns the parsed names of an image. Names that are not valid
+// references, and those hidden by the names of images from another host, are
+// ignored.
+func (cs *containerStorage) imageNames(idx *storeIndex, image *storage.Image) []imageName {
+	names := make([]imageName, 0, len(image.Names))
+	for _, n := range image.Names {
+		in, err := parseImageName(n, cs.hostPrefix)
+		if err != nil || idx.hidden(in) {
+			continue
+		}
+		names = append(names, in)
+	}
+	return names
+}
+
+// strippedHosts returns the host whose images are served in each repository
+// to which the names of images from more than one registry host are mapped,
+// as e.g. docker.io/library/foo and quay.io/library/foo both are in strip
+// mode. The host is localhost if it is one of them, since images pushed to
+// the registry are stored there, or otherwise the first in alphabetical
+// order.
+func (cs *containerStorage) strippedHosts(images []storage.Image) map[string]string {
+	if cs.hostPrefix != hostPrefixStrip {
+		return nil
+	}
+	repoHosts := map[string]map[string]struct{}{}
+	for i := range images {
+		for _, n := range images[i].Names {
+			in, err := parseImageName(n, cs.hostPrefix)
+			if err != nil {
+				continue
+			}
+			if repoHosts[in.repo] == nil {
+				repoHosts[in.repo] = map[string]struct{}{}
+			}
+			repoHosts[in.repo][in.host] = struct{}{}
+		}
+	}
+	chosen := map[string]string{}
+	for repo, hosts := range repoHosts {
+		if len(hosts) < 2 {
+			continue
+		}
+		if _, ok := hosts["localhost"]; ok {
+			chosen[repo] = "localhost"
+		} else {
+			chosen[repo] = slices.Min(slices.Collect(maps.Keys(hosts)))
+		}
+	}
+	return chosen
+}
+
+// storageName returns the containers-storage name under which to store an
+// image pushed to a repository, such that parseImageName maps it back to the
+// same repository.
+func storageName(repo string, mode hostPrefixMode) (reference.Named, error) {
+	name := repo
+	if mode == hostPrefixStrip {
+		// The original host is unknown, so treat the image as local
+		name = "localhost/" + repo
+	} else if first, rest, ok := strings.Cut(repo, "/"); ok {
+		if host, ok := storageHost(first); ok {
+			name = host + "/" + rest
+		}
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, err
+	}
+	if in, err := parseImageName(named.Name(), mode); err != nil || in.repo != repo {
+		return nil, fmt.Errorf("repository %q has no image name in host prefix mode %q", repo, mode)
+	}
+	return named, nil
+}
@@ -0,0 +1,53 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageName(t *testing.T) {
+	const dgst = "sha256:e9b1ebd668736b15a9c564b21d228266365144ab84ff83efd4fbd0dbf48cf270"
+	for _, tc := range []struct {
+		name     string
+		mode     hostPrefixMode
+		expected imageName
+	}{
+		{"docker.io/library/nginx:latest", hostPrefixKeep, imageName{host: "docker.io", repo: "docker.io/library/nginx", tag: "latest"}},
+		{"docker.io/library/nginx:latest", hostPrefixStrip, imageName{host: "docker.io", repo: "library/nginx", tag: "latest"}},
+		{"docker.io/library/nginx:latest", hostPrefixFamiliar, imageName{host: "docker.io", repo: "nginx", tag: "latest"}},
+		{"docker.io/foo/bar:1.0", hostPrefixFamiliar, imageName{host: "docker.io", repo: "foo/bar", tag: "1.0"}},
+		{"localhost/foo:dev", hostPrefixKeep, imageName{host: "localhost", repo: "localhost/foo", tag: "dev"}},
+		{"localhost/foo:dev", hostPrefixStrip, imageName{host: "localhost", repo: "foo", tag: "dev"}},
+		{"localhost/foo:dev", hostPrefixFamiliar, imageName{host: "localhost", repo: "localhost/foo", tag: "dev"}},
+		{"localhost:5000/foo/bar", hostPrefixKeep, imageName{host: "localhost:5000", repo: "localhost_5000/foo/bar"}},
+		{"localhost:5000/foo/bar", hostPrefixStrip, imageName{host: "localhost:5000", repo: "foo/bar"}},
+		{"localhost:5000/foo/bar", hostPrefixFamiliar, imageName{host: "localhost:5000", repo: "localhost_5000/foo/bar"}},
+		{"quay.io/foo/bar@" + dgst, hostPrefixStrip, imageName{host: "quay.io", repo: "foo/bar", digest: dgst}},
+		{"quay.io/foo/bar:v1@" + dgst, hostPrefixKeep, imageName{host: "quay.io", repo: "quay.io/foo/bar", tag: "v1", digest: dgst}},
+	} {
+		in, err := parseImageName(tc.name, tc.mode)
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.expected, in, "%s (%s)", tc.name, tc.mode)
+		}
+	}
+}
+
+func TestParseImageNameInvalid(t *testing.T) {
+	_, err := parseImageName("Quay.io/Foo:latest", hostPrefixKeep)
+	assert.Error(t, err)
+	// An IPv6 host cannot be part of a repository name
+	_, err = parseImageName("[::1]:5000/foo:latest", hostPrefixKeep)
+	assert.Error(t, err)
+	_, err = parseImageName("[::1]:5000/foo:latest", hostPrefixStrip)
+	assert.NoError(t, err)
+}
+
+func TestParseHostPrefixMode(t *testing.T) {
+	mode, err := parseHostPrefixMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, hostPrefixKeep, mode)
+
+	_, err = parseHostPrefixMode("drop")
+	assert.ErrorContains(t, err, "drop")
+}
@@ -0,0 +1,427 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/storage"
+	storagetypes "github.com/containers/storage/types"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/docker/go-units"
+)
+
+const (
+	paramGraphRoot       = "graphroot"
+	paramRunRoot         = "runroot"
+	paramDriver          = "driver"
+	paramDriverOptions   = "driveroptions"
+	paramStorageConf     = "storageconf"
+	paramHostPrefix      = "hostprefix"
+	paramCacheDir        = "cachedir"
+	paramCacheSize       = "cachesize"
+	paramCompressors     = "compressors"
+	paramUploadDir       = "uploaddir"
+	paramAllowDelete     = "allowdelete"
+	paramSynthesize      = "synthesizemanifests"
+	paramWatchInterval   = "watchinterval"
+	paramAdditional      = "additionalimagestores"
+	paramStores          = "stores"
+	paramPrefix          = "prefix"
+	paramMaxThreads      = "maxthreads"
+	paramMaxCompressions = "maxcompressions"
+
+	// paramUserAgent is added to the parameters of every storage driver by
+	// the registry itself, for drivers that make HTTP requests. It is
+	// ignored.
+	paramUserAgent = "useragent"
+)
+
+// driverParameters holds the configuration options accepted in the
+// storage.containerstorage section of the registry config file.
+type driverParameters struct {
+	graphRoot           string
+	runRoot             string
+	driver              string
+	driverOptions       []string
+	storageConf         string
+	hostPrefix          hostPrefixMode
+	cacheDir            string
+	cacheSize           int64
+	compressors         []string
+	uploadDir           string
+	allowDelete         bool
+	synthesizeManifests bool
+	watchInterval       time.Duration
+	// additionalImageStores are read-only image stores whose images are
+	// served along with those in the store itself.
+	additionalImageStores []string
+	// stores holds the parameters of each store when serving several
+	// stores together. Each inherits the other options from the top level.
+	stores []*driverParameters
+	// prefix is prepended to the names of repositories in one of several
+	// stores.
+	prefix string
+	// maxThreads limits the number of storage operations handled at once.
+	maxThreads uint64
+	// maxCompressions limits the number of layer blobs reproduced at once.
+	maxCompressions uint64
+}
+
+const (
+	// defaultWatchInterval is how often the container store is checked
+	// for changes made by other processes.
+	defaultWatchInterval = time.Second
+	// defaultMaxThreads and minThreads are those of the registry's
+	// filesystem driver.
+	defaultMaxThreads = uint64(100)
+	minThreads        = uint64(25)
+	// defaultSpoolSize is the maximum total size of the blobs kept in a
+	// temporary directory when no cache directory is configured.
+	defaultSpoolSize = int64(4 << 30)
+)
+
+func fromParameters(parameters map[string]interface{}) (*driverParameters, error) {
+	params := &driverParameters{
+		hostPrefix:      hostPrefixKeep,
+		compressors:     defaultCompressors,
+		watchInterval:   defaultWatchInterval,
+		maxThreads:      defaultMaxThreads,
+		maxCompressions: uint64(runtime.NumCPU()),
+	}
+	unknown := []string{}
+	var stores interface{}
+	for key, value := range parameters {
+		if ok, err := params.setStoreParameter(key, value); ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var err error
+		switch key {
+		case paramStores:
+			stores = value
+		case paramHostPrefix:
+			var mode string
+			if mode, err = stringParameter(key, value); err == nil {
+				params.hostPrefix, err = parseHostPrefixMode(mode)
+			}
+		case paramCacheDir:
+			params.cacheDir, err = stringParameter(key, value)
+		case paramCacheSize:
+			params.cacheSize, err = sizeParameter(key, value)
+		case paramCompressors:
+			var names []string
+			if names, err = stringListParameter(key, value); err == nil && names != nil {
+				params.compressors = names
+				_, err = getCompressors(names)
+			}
+		case paramUploadDir:
+			params.uploadDir, err = stringParameter(key, value)
+		case paramAllowDelete:
+			params.allowDelete, err = boolParameter(key, value)
+		case paramSynthesize:
+			params.synthesizeManifests, err = boolParameter(key, value)
+		case paramWatchInterval:
+			params.watchInterval, err = durationParameter(key, value)
+		case paramMaxThreads:
+			params.maxThreads, err = limitParameter(key, value, minThreads, defaultMaxThreads)
+		case paramMaxCompressions:
+			params.maxCompressions, err = limitParameter(key, value, 1, params.maxCompressions)
+		case paramUserAgent:
+		default:
+			unknown = append(unknown, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown containerstorage parameters: %s",
+			strings.Join(unknown, ", "))
+	}
+	if stores != nil {
+		var err error
+		if params.stores, err = params.storeListParameter(stores); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// setStoreParameter sets an option that selects a container store, and
+// returns false if the key is not such an option.
+func (p *driverParameters) setStoreParameter(key string, value interface{}) (bool, error) {
+	var err error
+	switch key {
+	case paramGraphRoot:
+		p.graphRoot, err = stringParameter(key, value)
+	case paramRunRoot:
+		p.runRoot, err = stringParameter(key, value)
+	case paramDriver:
+		p.driver, err = stringParameter(key, value)
+	case paramStorageConf:
+		p.storageConf, err = stringParameter(key, value)
+	case paramDriverOptions:
+		p.driverOptions, err = stringListParameter(key, value)
+	case paramAdditional:
+		p.additionalImageStores, err = stringListParameter(key, value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// storeListParameter returns the parameters of each store in the list given
+// in the stores option. Options not given for a store are inherited from p.
+func (p *driverParameters) storeListParameter(value interface{}) ([]*driverParameters, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("containerstorage parameter %q must be a list, not %T", paramStores, value)
+	}
+	stores := make([]*driverParameters, 0, len(list))
+	prefixes := map[string]struct{}{}
+	for i, item := range list {
+		entry, err := mapParameter(fmt.Sprintf("%s[%d]", paramStores, i), item)
+		if err != nil {
+			return nil, err
+		}
+		store := *p
+		store.stores = nil
+		unknown := []string{}
+		for key, value := range entry {
+			if ok, err := store.setStoreParameter(key, value); ok {
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if key != paramPrefix {
+				unknown = append(unknown, key)
+				continue
+			}
+			if store.prefix, err = stringParameter(key, value); err != nil {
+				return nil, err
+			}
+			if _, err := reference.WithName(store.prefix); err != nil && store.prefix != "" {
+				return nil, fmt.Errorf("containerstorage parameter %q: invalid prefix %q: %w", paramStores, store.prefix, err)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return nil, fmt.Errorf("unknown parameters in containerstorage store %d: %s",
+				i, strings.Join(unknown, ", "))
+		}
+		if _, dup := prefixes[store.prefix]; dup && store.prefix != "" {
+			return nil, fmt.Errorf("containerstorage parameter %q: prefix %q is used more than once", paramStores, store.prefix)
+		}
+		prefixes[store.prefix] = struct{}{}
+		stores = append(stores, &store)
+	}
+	return stores, nil
+}
+
+// mapParameter returns an option whose value is a map with string keys, as
+// decoded from either YAML or JSON.
+func mapParameter(key string, value interface{}) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("containerstorage parameter %q must have string keys, found %T", key, k)
+			}
+			m[s] = item
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("containerstorage parameter %q must be a map, not %T", key, value)
+}
+
+func stringParameter(key string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("containerstorage parameter %q must be a string, not %T", key, value)
+}
+
+func boolParameter(key string, value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("containerstorage parameter %q: %w", key, err)
+		}
+		return b, nil
+	}
+	return false, fmt.Errorf("containerstorage parameter %q must be a boolean, not %T", key, value)
+}
+
+func durationParameter(key string, value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case time.Duration:
+		return v, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("containerstorage parameter %q: %w", key, err)
+		}
+		return d, nil
+	}
+	return 0, fmt.Errorf("containerstorage parameter %q must be a duration, not %T", key, value)
+}
+
+func sizeParameter(key string, value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint64:
+		return int64(v), nil
+	case string:
+		size, err := units.RAMInBytes(v)
+		if err != nil {
+			return 0, fmt.Errorf("containerstorage parameter %q: %w", key, err)
+		}
+		return size, nil
+	}
+	return 0, fmt.Errorf("containerstorage parameter %q must be a size, not %T", key, value)
+}
+
+// limitParameter returns a limit on concurrency, which is raised to min if
+// it is lower.
+func limitParameter(key string, value interface{}, min, def uint64) (uint64, error) {
+	limit, err := base.GetLimitFromParameter(value, min, def)
+	if err != nil {
+		return 0, fmt.Errorf("containerstorage parameter %q: %w", key, err)
+	}
+	return limit, nil
+}
+
+func stringListParameter(key string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.Split(v, ","), nil
+	case []string:
+		return v, nil
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("containerstorage parameter %q must be a list of strings, found %T", key, item)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("containerstorage parameter %q must be a list of strings, not %T", key, value)
+}
+
+func (p *driverParameters) storeOptions() (storagetypes.StoreOptions, error) {
+	var opts storagetypes.StoreOptions
+	if p.storageConf != "" {
+		// ReloadConfigurationFile silently ignores missing files
+		if _, err := os.Stat(p.storageConf); err != nil {
+			return opts, fmt.Errorf("cannot read storage config: %w", err)
+		}
+		if err := storagetypes.ReloadConfigurationFile(p.storageConf, &opts); err != nil {
+			return opts, fmt.Errorf("cannot load storage config %s: %w", p.storageConf, err)
+		}
+	} else {
+		var err error
+		opts, err = storage.DefaultStoreOptionsAutoDetectUID()
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	if p.graphRoot != "" {
+		opts.GraphRoot = p.graphRoot
+	}
+	if p.runRoot != "" {
+		opts.RunRoot = p.runRoot
+	}
+	if p.driver != "" {
+		opts.GraphDriverName = p.driver
+	}
+	if p.driverOptions != nil {
+		opts.GraphDriverOptions = p.driverOptions
+	} else if opts.GraphDriverName == "" || opts.GraphDriverName == "overlay" {
+		// This doesn't seem to help at all
+		opts.GraphDriverOptions = append(opts.GraphDriverOptions,
+			"overlay.ignore_chown_errors=true")
+	} else if opts.GraphDriverName == "vfs" && isRootless() {
+		// Without root, files in layers cannot be given their owners from
+		// the image. Diffs are still reproduced with the original owners,
+		// which containers-storage records separately.
+		opts.GraphDriverOptions = append(opts.GraphDriverOptions,
+			"vfs.ignore_chown_errors=true")
+	}
+
+	for _, ais := range p.additionalImageStores {
+		opts.GraphDriverOptions = append(opts.GraphDriverOptions,
+			fmt.Sprintf("%s.imagestore=%s", opts.GraphDriverName, ais))
+	}
+
+	if opts.GraphRoot == "" {
+		return opts, fmt.Errorf("containerstorage parameter %q is required when not configured in storage.conf", paramGraphRoot)
+	}
+	if opts.RunRoot == "" {
+		return opts, fmt.Errorf("containerstorage parameter %q is required when not configured in storage.conf", paramRunRoot)
+	}
+	return opts, nil
+}
+
+// additionalImageStores returns the read-only image stores given in the
+// graph driver options, whether from the additionalimagestores parameter or
+// from storage.conf.
+func additionalImageStores(opts storagetypes.StoreOptions) []string {
+	var stores []string
+	for _, option := range opts.GraphDriverOptions {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			continue
+		}
+		driver, name, _ := strings.Cut(strings.ToLower(key), ".")
+		if driver != "" && opts.GraphDriverName != "" && driver != opts.GraphDriverName {
+			continue
+		}
+		if name != "imagestore" && name != "additionalimagestore" {
+			continue
+		}
+		for _, dir := range strings.Split(value, ",") {
+			if dir != "" {
+				stores = append(stores, filepath.Clean(dir))
+			}
+		}
+	}
+	return stores
+}
@@ -0,0 +1,180 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromParameters(t *testing.T) {
+	params, err := fromParameters(map[string]interface{}{
+		"graphroot":     "/srv/registry/storage",
+		"runroot":       "/run/registry/storage",
+		"driver":        "vfs",
+		"driveroptions": []interface{}{"vfs.ignore_chown_errors=true"},
+	})
+	assert.NoError(t, err)
+	opts, err := params.storeOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, "/srv/registry/storage", opts.GraphRoot)
+	assert.Equal(t, "/run/registry/storage", opts.RunRoot)
+	assert.Equal(t, "vfs", opts.GraphDriverName)
+	assert.Equal(t, []string{"vfs.ignore_chown_errors=true"}, opts.GraphDriverOptions)
+}
+
+func TestFromParametersUnknownKey(t *testing.T) {
+	_, err := fromParameters(map[string]interface{}{
+		"graphroot":     "/srv/registry/storage",
+		"rootdirectory": "/var/lib/registry",
+	})
+	assert.ErrorContains(t, err, "rootdirectory")
+
+	// The registry sets this for every driver
+	_, err = fromParameters(map[string]interface{}{
+		"useragent": "docker-distribution/v3.0.0 go1.23.7",
+	})
+	assert.NoError(t, err)
+}
+
+func TestFromParametersBadType(t *testing.T) {
+	_, err := fromParameters(map[string]interface{}{
+		"graphroot": 42,
+	})
+	assert.ErrorContains(t, err, "graphroot")
+
+	_, err = fromParameters(map[string]interface{}{
+		"driveroptions": []interface{}{"overlay.mountopt=nodev", 1},
+	})
+	assert.ErrorContains(t, err, "driveroptions")
+}
+
+func TestStoreOptionsMissingStorageConf(t *testing.T) {
+	params, err := fromParameters(map[string]interface{}{
+		"storageconf": "/nonexistent/storage.conf",
+	})
+	assert.NoError(t, err)
+	_, err = params.storeOptions()
+	assert.ErrorContains(t, err, "/nonexistent/storage.conf")
+}
+
+func TestAdditionalImageStoresFromOptions(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "storage.conf")
+	require.NoError(t, os.WriteFile(conf, []byte(`[storage]
+driver = "vfs"
+graphroot = "/var/lib/containers/storage"
+runroot = "/run/containers/storage"
+
+[storage.options]
+additionalimagestores = ["/usr/lib/containers/storage"]
+`), 0o644))
+	params, err := fromParameters(map[string]interface{}{
+		"storageconf":           conf,
+		"additionalimagestores": []interface{}{"/srv/images/"},
+	})
+	require.NoError(t, err)
+	opts, err := params.storeOptions()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/usr/lib/containers/storage", "/srv/images"}, additionalImageStores(opts))
+
+	opts.GraphDriverOptions = []string{"overlay.imagestore=/a,/b", ".additionalimagestore=/c", "vfs.imagestore=/d", "overlay.mountopt=nodev"}
+	opts.GraphDriverName = "overlay"
+	assert.Equal(t, []string{"/a", "/b", "/c"}, additionalImageStores(opts))
+}
+
+func TestFromParametersCompressors(t *testing.T) {
+	params, err := fromParameters(map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultCompressors, params.compressors)
+
+	params, err = fromParameters(map[string]interface{}{
+		"compressors": []interface{}{"gzip-9", "klauspost-gzip-1", "pigz"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gzip-9", "klauspost-gzip-1", "pigz"}, params.compressors)
+
+	_, err = fromParameters(map[string]interface{}{
+		"compressors": []interface{}{"gzip", "lzma"},
+	})
+	assert.ErrorContains(t, err, "lzma")
+}
+
+func TestFromParametersStores(t *testing.T) {
+	params, err := fromParameters(map[string]interface{}{
+		"driver":    "vfs",
+		"cachesize": "1GiB",
+		"stores": []interface{}{
+			map[interface{}]interface{}{
+				"graphroot":             "/var/lib/containers/storage",
+				"runroot":               "/run/containers/storage",
+				"additionalimagestores": []interface{}{"/usr/lib/containers/storage"},
+			},
+			map[string]interface{}{
+				"graphroot": "/home/user/.local/share/containers/storage",
+				"runroot":   "/run/user/1000/containers",
+				"driver":    "overlay",
+				"prefix":    "user",
+			},
+		},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, params.stores, 2) {
+		assert.Equal(t, "vfs", params.stores[0].driver)
+		assert.Equal(t, "", params.stores[0].prefix)
+		assert.Equal(t, params.cacheSize, params.stores[0].cacheSize)
+		opts, err := params.stores[0].storeOptions()
+		assert.NoError(t, err)
+		assert.Equal(t, "/var/lib/containers/storage", opts.GraphRoot)
+		assert.Contains(t, opts.GraphDriverOptions, "vfs.imagestore=/usr/lib/containers/storage")
+		assert.Equal(t, "overlay", params.stores[1].driver)
+		assert.Equal(t, "user", params.stores[1].prefix)
+	}
+
+	for _, tc := range []struct {
+		stores   interface{}
+		expected string
+	}{
+		{"/var/lib/containers/storage", "must be a list"},
+		{[]interface{}{"/var/lib/containers/storage"}, "must be a map"},
+		{[]interface{}{map[string]interface{}{"prefix": "Not/Valid"}}, "invalid prefix"},
+		{[]interface{}{map[string]interface{}{"cachedir": "/var/cache"}}, "cachedir"},
+		{[]interface{}{
+			map[string]interface{}{"prefix": "user"},
+			map[string]interface{}{"prefix": "user"},
+		}, "more than once"},
+	} {
+		_, err := fromParameters(map[string]interface{}{"stores": tc.stores})
+		assert.ErrorContains(t, err, tc.expected)
+	}
+}
+
+func TestFromParametersLimits(t *testing.T) {
+	params, err := fromParameters(map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultMaxThreads, params.maxThreads)
+	assert.Equal(t, uint64(runtime.NumCPU()), params.maxCompressions)
+
+	params, err = fromParameters(map[string]interface{}{
+		"maxthreads":      50,
+		"maxcompressions": "2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(50), params.maxThreads)
+	assert.Equal(t, uint64(2), params.maxCompressions)
+
+	params, err = fromParameters(map[string]interface{}{
+		"maxthreads":      1,
+		"maxcompressions": 0,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, minThreads, params.maxThreads)
+	assert.Equal(t, uint64(1), params.maxCompressions)
+
+	_, err = fromParameters(map[string]interface{}{
+		"maxcompressions": "many",
+	})
+	assert.ErrorContains(t, err, "maxcompressions")
+}
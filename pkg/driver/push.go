@@ -0,0 +1,503 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/containers/storage"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Pushed blobs are staged in the upload directory until a manifest that
+// references them is pushed, at which point the image is created in the
+// container store from the staged layers, config and manifest. The upload
+// directory is laid out as follows:
+//
+//	blobs/sha256/<hex>                          staged blob content
+//	repositories/<repo>/_uploads/<id>/...       uploads in progress
+//	repositories/<repo>/_layers/<hex>           staged blob links
+//	pushed/sha256/<hex>                         pushed layer blobs
+//
+// Pushed layer blobs are kept in the cache directory instead, if there is
+// one. Staged blobs, links and uploads that are left behind by abandoned
+// pushes are removed once they have not been modified for stagedMaxAge.
+
+const (
+	// stagedMaxAge is the time after which abandoned staged content is
+	// removed.
+	stagedMaxAge = 24 * time.Hour
+	// purgeInterval is how often abandoned staged content is looked for.
+	purgeInterval = time.Hour
+)
+
+// manifestDigestFunc computes the digest of a manifest stored as image big
+// data.
+func manifestDigestFunc(b []byte) (digest.Digest, error) {
+	return digest.FromBytes(b), nil
+}
+
+// uploadPath returns the location in the upload directory of a file
+// belonging to an upload session, given its path relative to the
+// repository's _uploads directory.
+func (cs *containerStorage) uploadPath(repo, subPath string) (string, error) {
+	for _, s := range strings.Split(subPath, "/") {
+		if s == "." || s == ".." {
+			return "", fmt.Errorf("invalid upload path %q", subPath)
+		}
+	}
+	return filepath.Join(cs.uploadDir, "repositories", repo, "_uploads", subPath), nil
+}
+
+func (cs *containerStorage) stagedLinkDir(repo string) string {
+	return filepath.Join(cs.uploadDir, "repositories", repo, "_layers")
+}
+
+// putBlob stages a blob whose content is given directly.
+func (cs *containerStorage) putBlob(ctx context.Context, sha string, content io.Reader) (err error) {
+	_, span := cs.startSpan(ctx, "putBlob", attrDigest.String(sha))
+	defer endSpan(span, &err)
+	d := digest.NewDigestFromEncoded(digest.Canonical, sha)
+	_, _, err = cs.staged.put(d, func() (io.ReadCloser, error) {
+		return io.NopCloser(content), nil
+	})
+	return err
+}
+
+// moveUpload stages a blob from a completed upload.
+func (cs *containerStorage) moveUpload(ctx context.Context, repo, subPath, sha string) (err error) {
+	_, span := cs.startSpan(ctx, "moveUpload", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	path, err := cs.uploadPath(repo, subPath)
+	if err != nil {
+		return err
+	}
+	return cs.staged.insert(digest.NewDigestFromEncoded(digest.Canonical, sha), path)
+}
+
+// linkLayer records that a blob has been linked into a repository before
+// any image in the repository uses it.
+func (cs *containerStorage) linkLayer(ctx context.Context, repo, sha string) (err error) {
+	_, span := cs.startSpan(ctx, "linkLayer", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	dir := cs.stagedLinkDir(repo)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, sha), nil, 0o600)
+}
+
+// stagedLayers returns the blobs linked into a repository that are not yet
+// part of an image.
+func (cs *containerStorage) stagedLayers(repo string) []string {
+	entries, err := os.ReadDir(cs.stagedLinkDir(repo))
+	if err != nil {
+		return nil
+	}
+	shas := make([]string, 0, len(entries))
+	for _, e := range entries {
+		shas = append(shas, e.Name())
+	}
+	return shas
+}
+
+// pushedBlob returns a blob referenced by a pushed manifest. When several
+// stores are served together, the blob may be in another store, since the
+// registry does not ask for blobs that it already has to be pushed again.
+func (cs *containerStorage) pushedBlob(ctx context.Context, sha string) (blobFunc, int64, error) {
+	getBlobReader, size, err := cs.getBlob(ctx, sha)
+	if errors.Is(err, errNotFound) && cs.union != nil {
+		return cs.union.getBlob(ctx, sha)
+	}
+	return getBlobReader, size, err
+}
+
+// blobContent returns the content of a (small) blob.
+func (cs *containerStorage) blobContent(ctx context.Context, d digest.Digest) ([]byte, error) {
+	getBlobReader, _, err := cs.pushedBlob(ctx, d.Encoded())
+	if err != nil {
+		return nil, err
+	}
+	r, err := getBlobReader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// putManifest creates or names the image for a manifest pushed to a
+// repository.
+func (cs *containerStorage) putManifest(ctx context.Context, repo, sha string) (err error) {
+	ctx, span := cs.startSpan(ctx, "putManifest", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	named, err := storageName(repo, cs.hostPrefix)
+	if err != nil {
+		return err
+	}
+	cs.pushing.Lock()
+	defer cs.pushing.Unlock()
+	d := digest.NewDigestFromEncoded(digest.Canonical, sha)
+	canonical, err := reference.WithDigest(named, d)
+	if err != nil {
+		return err
+	}
+	ctx = dcontext.WithLogger(ctx, dcontext.GetLoggerWithField(ctx, "digest", d))
+
+	if image, err := cs.manifestImage(d); err == nil {
+		// Already in the store, perhaps in another repository
+		return cs.store.AddNames(image.ID, []string{canonical.String()})
+	}
+
+	b, err := cs.blobContent(ctx, d)
+	if err != nil {
+		return fmt.Errorf("cannot read manifest %s: %w", d, err)
+	}
+	var manifest struct {
+		Config    v1.Descriptor   `json:"config"`
+		Layers    []v1.Descriptor `json:"layers"`
+		Manifests []v1.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return fmt.Errorf("cannot parse manifest %s: %w", d, err)
+	}
+
+	if isManifestList(b) {
+		err = cs.putManifestList(d, b, manifest.Manifests)
+	} else if manifest.Config.Digest != "" {
+		err = cs.putImageManifest(ctx, repo, d, b, manifest.Config, manifest.Layers)
+	} else {
+		err = fmt.Errorf("manifest %s is of an unsupported type", d)
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("containerstorage: cannot import pushed manifest: %v", err)
+		return err
+	}
+
+	image, err := cs.manifestImage(d)
+	if err != nil {
+		return err
+	}
+	dcontext.GetLoggerWithField(ctx, "image", image.ID).Infof("containerstorage: imported pushed manifest into %s", repo)
+	return cs.store.AddNames(image.ID, []string{canonical.String()})
+}
+
+// putImageManifest creates an image from the staged blobs referenced by a
+// manifest.
+func (cs *containerStorage) putImageManifest(ctx context.Context, repo string, d digest.Digest, b []byte, config v1.Descriptor, layers []v1.Descriptor) error {
+	planned, err := cs.pushedLayers(layers)
+	if err != nil {
+		return err
+	}
+	configData, err := cs.blobContent(ctx, config.Digest)
+	if err != nil {
+		return fmt.Errorf("cannot read config %s: %w", config.Digest, err)
+	}
+
+	parent := ""
+	for _, pl := range planned {
+		layer := pl.layer
+		if layer == nil {
+			layer, err = cs.putLayer(ctx, parent, pl.digest, pl.blob)
+			if err != nil {
+				return fmt.Errorf("cannot create layer %s: %w", pl.digest, err)
+			}
+		}
+		parent = layer.ID
+	}
+
+	_, err = cs.store.CreateImage(config.Digest.Encoded(), nil, parent, "", &storage.ImageOptions{
+		BigData: []storage.ImageBigDataOption{
+			{Key: config.Digest.String(), Data: configData, Digest: config.Digest},
+			{Key: storage.ImageDigestBigDataKey, Data: b, Digest: d},
+		},
+	})
+	if errors.Is(err, storage.ErrDuplicateID) {
+		// The same image was pushed before with a different manifest
+		err = cs.store.SetImageBigData(config.Digest.Encoded(),
+			storage.ImageDigestManifestBigDataNamePrefix+"-"+d.String(), b, manifestDigestFunc)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The blobs are now in the store
+	for _, l := range layers {
+		if _, _, ok := cs.staged.get(l.Digest); ok {
+			// Keep the original compressed blob, since it may not
+			// be reproducible
+			if err := cs.pushed.insert(l.Digest, cs.staged.blobPath(l.Digest)); err != nil {
+				dcontext.GetLoggerWithField(ctx, "layer", l.Digest).Warnf("containerstorage: cannot keep pushed layer blob: %v", err)
+				cs.staged.remove(l.Digest)
+			}
+		}
+		cs.unstage(repo, l.Digest)
+	}
+	cs.staged.remove(config.Digest)
+	cs.unstage(repo, config.Digest)
+	cs.staged.remove(d)
+	return nil
+}
+
+// pushedLayer is a layer referenced by a pushed manifest: either one that is
+// already in the store, or the blob from which to create it.
+type pushedLayer struct {
+	digest digest.Digest
+	layer  *storage.Layer
+	blob   blobFunc
+}
+
+// pushedLayers checks that each layer referenced by a pushed manifest can be
+// created without reproducing its blob, which could take far longer than a
+// request should, before anything is written to the store. Layers that are
+// already in the store on top of the layers before them are reused. The
+// others must have been pushed to the registry, or be kept by it in their
+// original compressed form.
+func (cs *containerStorage) pushedLayers(layers []v1.Descriptor) ([]pushedLayer, error) {
+	planned := make([]pushedLayer, 0, len(layers))
+	parent := ""
+	reusing := true
+	for _, l := range layers {
+		pl := pushedLayer{digest: l.Digest}
+		if reusing {
+			if layer := cs.childLayer(parent, l.Digest); layer != nil {
+				pl.layer = layer
+				parent = layer.ID
+				planned = append(planned, pl)
+				continue
+			}
+			// Layers on top of a new one cannot be in the store
+			reusing = false
+		}
+		if getBlobReader, _, ok := cs.staged.get(l.Digest); ok {
+			pl.blob = getBlobReader
+		} else if getBlobReader, ok := cs.originalBlob(l.Digest); ok {
+			pl.blob = getBlobReader
+		} else {
+			return nil, fmt.Errorf("layer %s was not pushed to the registry", l.Digest)
+		}
+		planned = append(planned, pl)
+	}
+	return planned, nil
+}
+
+// childLayer returns the layer with the given parent created from a blob,
+// if there is one.
+func (cs *containerStorage) childLayer(parent string, d digest.Digest) *storage.Layer {
+	layers, err := cs.store.LayersByCompressedDigest(d)
+	if err != nil {
+		return nil
+	}
+	for i := range layers {
+		if layers[i].Parent == parent {
+			return &layers[i]
+		}
+	}
+	return nil
+}
+
+// originalBlob returns a layer blob that the registry keeps in its original
+// compressed form, having had it pushed or having reproduced it already.
+// When several stores are served together, the blob may be kept by any of
+// them.
+func (cs *containerStorage) originalBlob(d digest.Digest) (blobFunc, bool) {
+	if cs.union != nil {
+		return cs.union.originalBlob(d)
+	}
+	return cs.keptBlob(d)
+}
+
+// keptBlob returns a layer blob kept by this store in its original
+// compressed form.
+func (cs *containerStorage) keptBlob(d digest.Digest) (blobFunc, bool) {
+	for _, c := range []*blobCache{cs.pushed, cs.cache} {
+		if getBlobReader, _, ok := c.get(d); ok {
+			return getBlobReader, true
+		}
+	}
+	return nil, false
+}
+
+// putLayer creates a layer with the given parent from a blob.
+func (cs *containerStorage) putLayer(ctx context.Context, parent string, d digest.Digest, getBlobReader blobFunc) (_ *storage.Layer, err error) {
+	ctx, span := cs.startSpan(ctx, "putLayer", attrDigest.String(d.Encoded()))
+	defer endSpan(span, &err)
+	r, err := getBlobReader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	layer, _, err := cs.store.PutLayer("", parent, nil, "", false, &storage.LayerOptions{
+		OriginalDigest: d,
+	}, r)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attrLayer.String(layer.ID))
+	dcontext.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+		"blob":  d,
+		"layer": layer.ID,
+	}).Debug("containerstorage: created layer from pushed blob")
+	return layer, nil
+}
+
+// putManifestList records a manifest list or image index with each of the
+// images it references that are in the store.
+func (cs *containerStorage) putManifestList(d digest.Digest, b []byte, manifests []v1.Descriptor) error {
+	found := false
+	for _, m := range manifests {
+		images, err := cs.store.ImagesByDigest(m.Digest)
+		if err != nil {
+			continue
+		}
+		for _, image := range images {
+			if err := cs.store.SetImageBigData(image.ID,
+				storage.ImageDigestManifestBigDataNamePrefix+"-"+d.String(), b, manifestDigestFunc); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no image in manifest list %s is in the store", d)
+	}
+	cs.staged.remove(d)
+	return nil
+}
+
+// purgeStaged removes staged blobs, staged blob links and uploads that have
+// not been modified since before the given time.
+func (cs *containerStorage) purgeStaged(ctx context.Context, before time.Time) {
+	logger := dcontext.GetLogger(ctx)
+	if staged, err := cs.staged.list(); err == nil {
+		for _, d := range staged {
+			if t, ok := cs.staged.modTime(d); ok && t.Before(before) {
+				logger.Infof("containerstorage: removing abandoned staged blob %s", d)
+				cs.staged.remove(d)
+			}
+		}
+	}
+	filepath.WalkDir(filepath.Join(cs.uploadDir, "repositories"), func(path string, e fs.DirEntry, err error) error {
+		if err != nil || !e.IsDir() {
+			return nil
+		}
+		switch e.Name() {
+		case "_layers":
+			entries, _ := os.ReadDir(path)
+			for _, link := range entries {
+				if info, err := link.Info(); err == nil && info.ModTime().Before(before) {
+					os.Remove(filepath.Join(path, link.Name()))
+				}
+			}
+			return fs.SkipDir
+		case "_uploads":
+			entries, _ := os.ReadDir(path)
+			for _, upload := range entries {
+				uploadPath := filepath.Join(path, upload.Name())
+				if modifiedSince(uploadPath, before) {
+					continue
+				}
+				logger.Infof("containerstorage: removing abandoned upload %s", uploadPath)
+				os.RemoveAll(uploadPath)
+			}
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+// modifiedSince returns whether any file within a directory has been
+// modified since the given time.
+func modifiedSince(dir string, t time.Time) bool {
+	modified := false
+	filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := e.Info(); err == nil && !info.ModTime().Before(t) {
+			modified = true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return modified
+}
+
+// purge removes abandoned staged content at intervals until the driver is
+// closed.
+func (cs *containerStorage) purge(interval time.Duration) {
+	defer cs.watching.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cs.purgeStaged(context.Background(), time.Now().Add(-stagedMaxAge))
+		select {
+		case <-cs.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// unstage removes a blob's staged link from a repository.
+func (cs *containerStorage) unstage(repo string, d digest.Digest) {
+	os.Remove(filepath.Join(cs.stagedLinkDir(repo), d.Encoded()))
+}
+
+// putTag names the image for a manifest with a tag in a repository.
+func (cs *containerStorage) putTag(ctx context.Context, repo, tag, sha string) (err error) {
+	_, span := cs.startSpan(ctx, "putTag", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	named, err := storageName(repo, cs.hostPrefix)
+	if err != nil {
+		return err
+	}
+	tagged, err := reference.WithTag(named, tag)
+	if err != nil {
+		return err
+	}
+	image, err := cs.manifestImage(digest.NewDigestFromEncoded(digest.Canonical, sha))
+	if err != nil {
+		return err
+	}
+	return cs.store.AddNames(image.ID, []string{tagged.String()})
+}
+
+// manifestImage returns the image with the given manifest. Where the
+// manifest is a manifest list, the image for the host platform is preferred,
+// as when pulling.
+func (cs *containerStorage) manifestImage(d digest.Digest) (*storage.Image, error) {
+	images, err := cs.store.ImagesByDigest(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no image with manifest %s: %w", d, storage.ErrImageUnknown)
+	}
+	for _, image := range images {
+		for _, c := range bigDataBlobs(image) {
+			b, err := cs.store.ImageBigData(image.ID, c.String())
+			if err != nil {
+				continue
+			}
+			var platform v1.Platform
+			if json.Unmarshal(b, &platform) == nil &&
+				platform.OS == runtime.GOOS &&
+				platform.Architecture == runtime.GOARCH {
+				return image, nil
+			}
+		}
+	}
+	return images[0], nil
+}
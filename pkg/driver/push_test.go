@@ -0,0 +1,273 @@
+package driver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/reference"
+	registrystorage "github.com/distribution/distribution/v3/registry/storage"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRepository(t *testing.T, d *driver, name string, options ...registrystorage.RegistryOption) distribution.Repository {
+	t.Helper()
+	ctx := context.Background()
+	reg, err := registrystorage.NewRegistry(ctx, d, options...)
+	require.NoError(t, err)
+	named, err := reference.WithName(name)
+	require.NoError(t, err)
+	repo, err := reg.Repository(ctx, named)
+	require.NoError(t, err)
+	return repo
+}
+
+func pushTestBlob(t *testing.T, repo distribution.Repository, mediaType string, content []byte) distribution.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	w, err := repo.Blobs(ctx).Create(ctx)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	desc, err := w.Commit(ctx, distribution.Descriptor{Digest: digest.FromBytes(content)})
+	require.NoError(t, err)
+	desc.MediaType = mediaType
+	return desc
+}
+
+type pushedImage struct {
+	manifest  distribution.Manifest
+	digest    digest.Digest
+	config    distribution.Descriptor
+	layer     distribution.Descriptor
+	layerBlob []byte
+}
+
+// pushTestImage pushes a single-layer image to a repository through the
+// registry and tags it.
+func pushTestImage(t *testing.T, repo distribution.Repository, tag string, content string) pushedImage {
+	t.Helper()
+	layerTar := testLayerTar(t, "hello", content)
+	return pushTestImageLayer(t, repo, tag, layerTar, compressTestLayer(t, layerTar, archive.Gzip))
+}
+
+// pushTestImageLayer pushes an image with the given layer, compressed as
+// layer, to a repository through the registry and tags it.
+func pushTestImageLayer(t *testing.T, repo distribution.Repository, tag string, layerTar, layer []byte) pushedImage {
+	t.Helper()
+	ctx := context.Background()
+	layerDesc := pushTestBlob(t, repo, v1.MediaTypeImageLayerGzip, layer)
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           runtime.GOOS,
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []digest.Digest{digest.FromBytes(layerTar)},
+		},
+	})
+	require.NoError(t, err)
+	configDesc := pushTestBlob(t, repo, v1.MediaTypeImageConfig, config)
+
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config:    configDesc,
+		Layers:    []distribution.Descriptor{layerDesc},
+	})
+	require.NoError(t, err)
+	ms, err := repo.Manifests(ctx)
+	require.NoError(t, err)
+	manifestDigest, err := ms.Put(ctx, m)
+	require.NoError(t, err)
+	require.NoError(t, repo.Tags(ctx).Tag(ctx, tag, distribution.Descriptor{Digest: manifestDigest}))
+	return pushedImage{
+		manifest:  m,
+		digest:    manifestDigest,
+		config:    configDesc,
+		layer:     layerDesc,
+		layerBlob: layer,
+	}
+}
+
+func TestPush(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	repo := newTestRepository(t, &driver{store: cs}, "localhost/foo")
+	pushed := pushTestImage(t, repo, "latest", "Hello, World!")
+
+	image, err := cs.store.Image(pushed.config.Digest.Encoded())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"localhost/foo:latest",
+		"localhost/foo@" + pushed.digest.String(),
+	}, image.Names)
+	layers, err := cs.store.LayersByCompressedDigest(pushed.layer.Digest)
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	assert.Equal(t, image.TopLayer, layers[0].ID)
+
+	// Staged blobs have been moved into the store
+	staged, err := cs.staged.list()
+	require.NoError(t, err)
+	assert.Empty(t, staged)
+
+	desc, err := repo.Tags(ctx).Get(ctx, "latest")
+	require.NoError(t, err)
+	assert.Equal(t, pushed.digest, desc.Digest)
+	_, payload, err := pushed.manifest.Payload()
+	require.NoError(t, err)
+	ms, err := repo.Manifests(ctx)
+	require.NoError(t, err)
+	pulled, err := ms.Get(ctx, pushed.digest)
+	require.NoError(t, err)
+	_, pulledPayload, err := pulled.Payload()
+	require.NoError(t, err)
+	assert.Equal(t, payload, pulledPayload)
+	b, err := repo.Blobs(ctx).Get(ctx, pushed.layer.Digest)
+	require.NoError(t, err)
+	assert.Equal(t, pushed.layerBlob, b)
+}
+
+func TestPushUnreproducibleLayer(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	repo := newTestRepository(t, &driver{store: cs}, "localhost/foo")
+	layerTar := testLayerTar(t, "hello", "Hello, World!")
+	pushed := pushTestImageLayer(t, repo, "latest", layerTar, gzipTestLayer(t, layerTar, gzip.NoCompression))
+	other := compressTestLayer(t, testLayerTar(t, "goodbye", "Goodbye!"), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/bar:latest"}, other)
+
+	// Reproducing other blobs does not evict the pushed one
+	assert.Equal(t, other, readTestBlob(t, cs, img.layers[0]))
+	_, _, ok := cs.pushed.get(pushed.layer.Digest)
+	assert.True(t, ok)
+	_, _, ok = cs.cache.get(pushed.layer.Digest)
+	assert.False(t, ok)
+	b, err := repo.Blobs(ctx).Get(ctx, pushed.layer.Digest)
+	require.NoError(t, err)
+	assert.Equal(t, pushed.layerBlob, b)
+}
+
+func TestPushLayerNotPushed(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"},
+		compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip),
+		compressTestLayer(t, testLayerTar(t, "goodbye", "Goodbye!"), archive.Gzip))
+	before, err := cs.store.Layers()
+	require.NoError(t, err)
+
+	// A manifest using only the top layer, which is in the store on top
+	// of another layer and was never pushed to the registry
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           runtime.GOOS,
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": img.diffIDs[1:],
+		},
+	})
+	require.NoError(t, err)
+	configDigest := digest.FromBytes(config)
+	manifest, err := json.Marshal(v1.Manifest{
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: configDigest, Size: int64(len(config))},
+		Layers:    []v1.Descriptor{{MediaType: v1.MediaTypeImageLayerGzip, Digest: img.layers[1]}},
+	})
+	require.NoError(t, err)
+	manifestDigest := digest.FromBytes(manifest)
+	require.NoError(t, cs.putBlob(ctx, configDigest.Encoded(), bytes.NewReader(config)))
+	require.NoError(t, cs.putBlob(ctx, manifestDigest.Encoded(), bytes.NewReader(manifest)))
+
+	err = cs.putManifest(ctx, "localhost/bar", manifestDigest.Encoded())
+	assert.ErrorContains(t, err, "was not pushed")
+	after, err := cs.store.Layers()
+	require.NoError(t, err)
+	assert.Len(t, after, len(before))
+	// The blob was not reproduced either
+	_, _, ok := cs.cache.get(img.layers[1])
+	assert.False(t, ok)
+}
+
+func TestPurgeStaged(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	repo := newTestRepository(t, &driver{store: cs}, "localhost/foo")
+	pushTestBlob(t, repo, "application/octet-stream", []byte("old"))
+	recent := pushTestBlob(t, repo, "application/octet-stream", []byte("recent"))
+	w, err := repo.Blobs(ctx).Create(ctx)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("abandoned"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Age everything but the recent blob and its link
+	then := time.Now().Add(-2 * stagedMaxAge)
+	require.NoError(t, filepath.WalkDir(cs.uploadDir, func(path string, e os.DirEntry, err error) error {
+		if err != nil || filepath.Base(path) == recent.Digest.Encoded() {
+			return err
+		}
+		return os.Chtimes(path, then, then)
+	}))
+	cs.purgeStaged(ctx, time.Now().Add(-stagedMaxAge))
+
+	staged, err := cs.staged.list()
+	require.NoError(t, err)
+	assert.Equal(t, []digest.Digest{recent.Digest}, staged)
+	assert.Equal(t, []string{recent.Digest.Encoded()}, cs.stagedLayers("localhost/foo"))
+	uploads, err := os.ReadDir(filepath.Join(cs.uploadDir, "repositories", "localhost/foo", "_uploads"))
+	require.NoError(t, err)
+	assert.Empty(t, uploads)
+}
+
+func TestPushStagedBlob(t *testing.T) {
+	ctx := context.Background()
+	cs := newTestStorage(t)
+	repo := newTestRepository(t, &driver{store: cs}, "localhost/foo")
+
+	content := []byte("Hello, World!")
+	desc := pushTestBlob(t, repo, "application/octet-stream", content)
+
+	layers, err := cs.listRepoLayers(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.Contains(t, layers, desc.Digest.Encoded())
+	b, err := repo.Blobs(ctx).Get(ctx, desc.Digest)
+	require.NoError(t, err)
+	assert.Equal(t, content, b)
+}
+
+func TestStorageName(t *testing.T) {
+	for _, tc := range []struct {
+		repo     string
+		mode     hostPrefixMode
+		expected string
+	}{
+		{"localhost/foo", hostPrefixKeep, "localhost/foo"},
+		{"quay.io/foo/bar", hostPrefixKeep, "quay.io/foo/bar"},
+		{"foo", hostPrefixStrip, "localhost/foo"},
+		{"nginx", hostPrefixFamiliar, "docker.io/library/nginx"},
+		{"localhost/foo", hostPrefixFamiliar, "localhost/foo"},
+		{"localhost_5000/foo", hostPrefixKeep, "localhost:5000/foo"},
+		{"localhost_5000/foo", hostPrefixFamiliar, "localhost:5000/foo"},
+		{"foo_1/bar", hostPrefixStrip, "localhost/foo_1/bar"},
+	} {
+		named, err := storageName(tc.repo, tc.mode)
+		if assert.NoError(t, err, tc.repo) {
+			assert.Equal(t, tc.expected, named.String())
+		}
+	}
+
+	_, err := storageName("foo", hostPrefixKeep)
+	assert.Error(t, err)
+}
@@ -2,12 +2,15 @@ package driver
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
 )
 
 type repoList struct {
@@ -19,16 +22,11 @@ func (rl *repoList) Reader() (io.ReadCloser, error) {
 }
 
 func (rl *repoList) Stat() (storagedriver.FileInfo, error) {
-	return storagedriver.FileInfoInternal{
-		storagedriver.FileInfoFields{
-			Path:  rl.path(),
-			IsDir: true,
-		},
-	}, nil
+	return rl.dirInfo("")
 }
 
 func (rl *repoList) List() ([]string, error) {
-	repos, err := rl.store.listRepos()
+	repos, err := rl.store.listRepos(rl.ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -45,18 +43,13 @@ func (r *repo) Reader() (io.ReadCloser, error) {
 }
 
 func (r *repo) Stat() (storagedriver.FileInfo, error) {
-	repos, err := r.store.listRepos()
+	repos, err := r.store.listRepos(r.ctx)
 	if err != nil {
 		return nil, err
 	}
 	for _, repo := range repos {
 		if r.repo == repo {
-			return storagedriver.FileInfoInternal{
-				storagedriver.FileInfoFields{
-					Path:  r.path(),
-					IsDir: true,
-				},
-			}, nil
+			return r.dirInfo(r.repo)
 		}
 	}
 	return nil, storagedriver.PathNotFoundError{Path: r.path()}
@@ -75,7 +68,7 @@ type layerList struct {
 }
 
 func (ll *layerList) layers() ([]string, error) {
-	return ll.store.listRepoLayers(ll.repo)
+	return ll.store.listRepoLayers(ll.ctx, ll.repo)
 }
 
 func (ll *layerList) Reader() (io.ReadCloser, error) {
@@ -86,12 +79,7 @@ func (ll *layerList) Stat() (storagedriver.FileInfo, error) {
 	if _, err := ll.layers(); err != nil {
 		return nil, err
 	}
-	return storagedriver.FileInfoInternal{
-		storagedriver.FileInfoFields{
-			Path:  ll.path(),
-			IsDir: true,
-		},
-	}, nil
+	return ll.dirInfo(ll.repo)
 }
 
 func (ll *layerList) List() ([]string, error) {
@@ -120,7 +108,7 @@ type manifestList struct {
 }
 
 func (ml *manifestList) manifests() ([]string, error) {
-	return ml.store.listRepoRevisions(ml.repo)
+	return ml.store.listRepoRevisions(ml.ctx, ml.repo)
 }
 
 func (ml *manifestList) Reader() (io.ReadCloser, error) {
@@ -128,15 +116,10 @@ func (ml *manifestList) Reader() (io.ReadCloser, error) {
 }
 
 func (ml *manifestList) Stat() (storagedriver.FileInfo, error) {
-	if _, err := ml.manifests(); err != nil {
+	if _, err := ml.List(); err != nil {
 		return nil, err
 	}
-	return storagedriver.FileInfoInternal{
-		storagedriver.FileInfoFields{
-			Path:  ml.path(),
-			IsDir: true,
-		},
-	}, nil
+	return ml.dirInfo(ml.repo)
 }
 
 func (ml *manifestList) List() ([]string, error) {
@@ -144,70 +127,286 @@ func (ml *manifestList) List() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	if strings.HasSuffix(ml.subPath, "/_manifests") {
-		return ml.children("revisions"), nil
+	path := strings.Split(ml.subPath, "/")
+	path = path[strings.Count(ml.repo, "/")+3:]
+	if len(path) == 0 {
+		return ml.children("revisions", "tags"), nil
 	}
-	if strings.HasSuffix(ml.subPath, "/revisions") {
-		return ml.children("sha256"), nil
-	}
-	if strings.HasSuffix(ml.subPath, "/sha256") {
-		return ml.children(manifests...), nil
-	}
-	sha := ml.subPath[strings.LastIndex(ml.subPath, "/")+1:]
-	for _, m := range manifests {
-		if m == sha {
-			return ml.children("link"), nil
+	switch path[0] {
+	case "revisions":
+		switch len(path) {
+		case 1:
+			return ml.children("sha256"), nil
+		case 2:
+			if path[1] == "sha256" {
+				return ml.children(manifests...), nil
+			}
+		case 3:
+			if path[1] != "sha256" {
+				break
+			}
+			for _, m := range manifests {
+				if m == path[2] {
+					return ml.children("link"), nil
+				}
+			}
+		}
+	case "tags":
+		tags, err := ml.store.listRepoTags(ml.ctx, ml.repo)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 1 {
+			tagList := make([]string, 0, len(tags))
+			for t := range tags {
+				tagList = append(tagList, t)
+			}
+			return ml.children(tagList...), nil
+		}
+		sha, ok := tags[path[1]]
+		if !ok {
+			break
+		}
+		switch len(path) {
+		case 2:
+			return ml.children("current", "index"), nil
+		case 3:
+			switch path[2] {
+			case "current":
+				return ml.children("link"), nil
+			case "index":
+				return ml.children("sha256"), nil
+			}
+		case 4:
+			if path[2] == "index" && path[3] == "sha256" {
+				return ml.children(sha), nil
+			}
+		case 5:
+			if path[2] == "index" && path[3] == "sha256" && path[4] == sha {
+				return ml.children("link"), nil
+			}
 		}
 	}
 	return nil, storagedriver.PathNotFoundError{Path: ml.path()}
 }
 
+// delete removes a tag or manifest revision directory.
+func (ml *manifestList) delete() error {
+	_, rest := splitRepoPath(ml.subPath)
+	switch {
+	case len(rest) == 3 && rest[1] == "tags":
+		return ml.store.deleteTag(ml.ctx, ml.repo, rest[2])
+	case len(rest) == 6 && rest[1] == "tags" && rest[3] == "index" && rest[4] == "sha256":
+		return deleteTagIndex(ml.ctx, ml.store, ml.repo, rest[2], rest[5])
+	case len(rest) == 4 && rest[1] == "revisions" && rest[2] == "sha256":
+		return ml.store.deleteManifest(ml.ctx, ml.repo, rest[3])
+	}
+	return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+}
+
 type link struct {
 	filePath
 }
 
-func (l *link) linkDigest() (string, error) {
+// linkDigest returns the digest that a link refers to, using the algorithm
+// named in the link's path.
+func (l *link) linkDigest() (digest.Digest, error) {
 	path := strings.Split(l.subPath, "/")
 	if len(path) < 5 ||
 		path[len(path)-1] != "link" ||
-		path[len(path)-3] != "sha256" ||
 		path[0] != "repositories" {
 		return "", storagedriver.PathNotFoundError{Path: l.path()}
 	}
+	if path[len(path)-2] == "current" {
+		sha, err := l.tagDigest(path, len(path)-5)
+		if err != nil {
+			return "", err
+		}
+		return digest.NewDigestFromEncoded(digest.Canonical, sha), nil
+	}
+	d := digest.NewDigestFromEncoded(digest.Algorithm(path[len(path)-3]), path[len(path)-2])
+	if d.Validate() != nil {
+		return "", storagedriver.PathNotFoundError{Path: l.path()}
+	}
+	// The container store only records digests of the canonical algorithm
+	if d.Algorithm() != digest.Canonical {
+		return "", storagedriver.PathNotFoundError{Path: l.path()}
+	}
+	sha := d.Encoded()
 	repoEnd := len(path) - 4
 	switch path[repoEnd] {
 	case "_layers":
-		// TODO: check for layer existence
+		if err := l.checkLinked(path[1:repoEnd], sha, l.store.listRepoLayers); err != nil {
+			return "", err
+		}
 	case "revisions":
 		repoEnd -= 1
 		if path[repoEnd] != "_manifests" {
 			return "", storagedriver.PathNotFoundError{Path: l.path()}
 		}
-		// TODO: check for manifest existence
+		if err := l.checkLinked(path[1:repoEnd], sha, l.store.listRepoRevisions); err != nil {
+			return "", err
+		}
+	case "index":
+		tagSha, err := l.tagDigest(path, len(path)-7)
+		if err != nil {
+			return "", err
+		}
+		if tagSha != sha {
+			return "", storagedriver.PathNotFoundError{Path: l.path()}
+		}
 	default:
 		return "", storagedriver.PathNotFoundError{Path: l.path()}
 	}
-	return path[len(path)-2], nil
+	return d, nil
+}
+
+// checkLinked returns a PathNotFoundError unless the digest is in the list
+// returned for the repository whose name is given as path segments, so that
+// content in one repository cannot be reached through another.
+func (l *link) checkLinked(repoPath []string, sha string, list func(ctx context.Context, repo string) ([]string, error)) error {
+	if len(repoPath) == 0 {
+		return storagedriver.PathNotFoundError{Path: l.path()}
+	}
+	shas, err := list(l.ctx, strings.Join(repoPath, "/"))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(shas, sha) {
+		return storagedriver.PathNotFoundError{Path: l.path()}
+	}
+	return nil
+}
+
+// tagDigest returns the digest of the manifest currently tagged by a tag link
+// path, given the index of the _manifests segment in the path.
+func (l *link) tagDigest(path []string, manifestsIdx int) (string, error) {
+	if manifestsIdx < 2 ||
+		path[manifestsIdx] != "_manifests" ||
+		path[manifestsIdx+1] != "tags" {
+		return "", storagedriver.PathNotFoundError{Path: l.path()}
+	}
+	repo := strings.Join(path[1:manifestsIdx], "/")
+	tags, err := l.store.listRepoTags(l.ctx, repo)
+	if err != nil {
+		return "", err
+	}
+	sha, ok := tags[path[manifestsIdx+2]]
+	if !ok {
+		return "", storagedriver.PathNotFoundError{Path: l.path()}
+	}
+	return sha, nil
+}
+
+// put records a link written by the registry when a blob is linked into a
+// repository, a manifest is pushed or a tag is set.
+func (l *link) put(contents []byte) error {
+	d, err := digest.Parse(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return err
+	}
+	if d.Algorithm() != digest.Canonical {
+		return fmt.Errorf("unsupported digest algorithm %s", d.Algorithm())
+	}
+	repo, rest := splitRepoPath(l.subPath)
+	switch {
+	case len(rest) == 4 && rest[0] == "_layers" && rest[1] == "sha256":
+		if rest[2] != d.Encoded() {
+			break
+		}
+		return l.store.linkLayer(l.ctx, repo, d.Encoded())
+	case len(rest) == 5 && rest[0] == "_manifests" && rest[1] == "revisions" && rest[2] == "sha256":
+		if rest[3] != d.Encoded() {
+			break
+		}
+		return l.store.putManifest(l.ctx, repo, d.Encoded())
+	case len(rest) == 5 && rest[0] == "_manifests" && rest[1] == "tags" && rest[3] == "current":
+		return l.store.putTag(l.ctx, repo, rest[2], d.Encoded())
+	case len(rest) == 7 && rest[0] == "_manifests" && rest[1] == "tags" && rest[3] == "index":
+		// The tag history is not recorded separately from the current tag
+		if rest[5] != d.Encoded() {
+			break
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot write link %s", l.path())
+}
+
+// delete removes the blob link, manifest revision or tag at a link path.
+func (l *link) delete() error {
+	repo, rest := splitRepoPath(l.subPath)
+	switch {
+	case len(rest) == 4 && rest[0] == "_layers" && rest[1] == "sha256":
+		return l.store.deleteLayerLink(l.ctx, repo, rest[2])
+	case len(rest) == 5 && rest[0] == "_manifests" && rest[1] == "revisions" && rest[2] == "sha256":
+		return l.store.deleteManifest(l.ctx, repo, rest[3])
+	case len(rest) == 5 && rest[0] == "_manifests" && rest[1] == "tags" && rest[3] == "current":
+		return l.store.deleteTag(l.ctx, repo, rest[2])
+	case len(rest) == 7 && rest[0] == "_manifests" && rest[1] == "tags" && rest[3] == "index" && rest[4] == "sha256":
+		return deleteTagIndex(l.ctx, l.store, repo, rest[2], rest[5])
+	}
+	return storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+}
+
+// deleteTagIndex removes a tag if it currently refers to the given manifest,
+// since only the current manifest is recorded in the tag's index.
+func deleteTagIndex(ctx context.Context, s store, repo, tag, sha string) error {
+	tags, err := s.listRepoTags(ctx, repo)
+	if err != nil {
+		return err
+	}
+	if tags[tag] != sha {
+		return fmt.Errorf("tag %s of manifest %s in repository %s %w", tag, sha, repo, errNotFound)
+	}
+	return s.deleteTag(ctx, repo, tag)
+}
+
+// splitRepoPath splits a path in the repositories directory into the
+// repository name and the remaining path segments, starting from the first
+// segment that begins with an underscore.
+func splitRepoPath(subPath string) (string, []string) {
+	path := strings.Split(subPath, "/")
+	repoEnd := 2
+	for repoEnd < len(path) && !strings.HasPrefix(path[repoEnd], "_") {
+		repoEnd++
+	}
+	if repoEnd > len(path) {
+		repoEnd = len(path)
+	}
+	return strings.Join(path[1:repoEnd], "/"), path[repoEnd:]
+}
+
+// content returns the content of a link, which is the digest it refers to.
+func (l *link) content() ([]byte, string, error) {
+	d, err := l.linkDigest()
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(d.String()), d.Encoded(), nil
 }
 
 func (l *link) Reader() (io.ReadCloser, error) {
-	digest, err := l.linkDigest()
+	content, _, err := l.content()
 	if err != nil {
 		return nil, err
 	}
-	content := []byte(fmt.Sprintf("sha256:%s", digest))
 	return io.NopCloser(bytes.NewReader(content)), nil
 }
 
 func (l *link) Stat() (storagedriver.FileInfo, error) {
-	_, err := l.linkDigest()
+	content, sha, err := l.content()
+	if err != nil {
+		return nil, err
+	}
+	modTime, err := l.store.blobModTime(l.ctx, sha)
 	if err != nil {
 		return nil, err
 	}
 	return storagedriver.FileInfoInternal{
-		storagedriver.FileInfoFields{
-			Path: l.path(),
-			Size: 64 + 7,
+		FileInfoFields: storagedriver.FileInfoFields{
+			Path:    l.path(),
+			Size:    int64(len(content)),
+			ModTime: modTime,
 		},
 	}, nil
 }
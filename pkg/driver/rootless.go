@@ -0,0 +1,24 @@
+package driver
+
+import (
+	"github.com/containers/storage/pkg/unshare"
+)
+
+// isRootless reports whether the registry is running without root
+// privileges on the host, whether or not it is in a user namespace.
+var isRootless = unshare.IsRootless
+
+// ReexecInUserNamespace re-executes the current program in a new user
+// namespace when it is run by an unprivileged user, mapping the user to root
+// and their subordinate IDs from /etc/subuid and /etc/subgid to the other
+// users, as `podman unshare` does. Inside the namespace the driver can read
+// the files of every layer in the user's container store, including those
+// owned by other users in the image.
+//
+// Programs that embed the driver should call it at the start of main, after
+// reexec.Init. It returns immediately when running as root or when already
+// in a user namespace; otherwise it does not return, and the program exits
+// with the status of the re-executed copy.
+func ReexecInUserNamespace() {
+	unshare.MaybeReexecUsingUserNamespace(false)
+}
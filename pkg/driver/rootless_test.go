@@ -0,0 +1,72 @@
+package driver
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreOptionsRootless(t *testing.T) {
+	defer func(f func() bool) { isRootless = f }(isRootless)
+	params, err := fromParameters(map[string]interface{}{
+		"graphroot": "/home/user/.local/share/containers/storage",
+		"runroot":   "/run/user/1000/containers",
+		"driver":    "vfs",
+	})
+	require.NoError(t, err)
+
+	isRootless = func() bool { return false }
+	opts, err := params.storeOptions()
+	require.NoError(t, err)
+	assert.NotContains(t, opts.GraphDriverOptions, "vfs.ignore_chown_errors=true")
+
+	isRootless = func() bool { return true }
+	opts, err = params.storeOptions()
+	require.NoError(t, err)
+	assert.Contains(t, opts.GraphDriverOptions, "vfs.ignore_chown_errors=true")
+}
+
+// TestRootless serves an image from a store created by an unprivileged
+// user. It is skipped when run as root; to run it, build the test binary and
+// run it as another user in a user namespace, as the registry itself runs
+// after ReexecInUserNamespace, e.g.:
+//
+//	go test -c -o /tmp/driver.test ./pkg/driver
+//	cd /tmp && setpriv --reuid=nobody --regid=nogroup --clear-groups \
+//		env TMPDIR=/tmp unshare --map-root-user /tmp/driver.test -test.run TestRootless
+//
+// or, as an ordinary user, `podman unshare go test -run TestRootless ./pkg/driver`.
+func TestRootless(t *testing.T) {
+	if !isRootless() {
+		t.Skip("must be run as an unprivileged user")
+	}
+	cs := newTestStorageWithParams(t, map[string]interface{}{})
+
+	// Files in the image are owned by users other than the one running the
+	// registry, so they cannot be given their owners in the store.
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for i, owner := range []int{0, 1000, 65533} {
+		content := []byte("Hello, World!")
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     string(rune('a' + i)),
+			Mode:     0o644,
+			Uid:      owner,
+			Gid:      owner,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	layer := compressTestLayer(t, buf.Bytes(), archive.Gzip)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	assert.Equal(t, layer, readTestBlob(t, cs, img.layers[0]))
+	assert.Equal(t, buf.Bytes(), readTestBlob(t, cs, img.diffIDs[0]))
+}
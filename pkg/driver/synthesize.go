@@ -0,0 +1,227 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containers/storage"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// synthesizedManifestKey is the image big data key under which a manifest
+// generated for an image with unreproducible layers is stored. Because it
+// begins with the manifest prefix, containers/storage records its digest
+// alongside those of the image's other manifests.
+const synthesizedManifestKey = storage.ImageDigestManifestBigDataNamePrefix + "-synthesized"
+
+const (
+	// synthesisQueueSize is the number of images that may wait to be
+	// checked for a synthesized manifest.
+	synthesisQueueSize = 100
+	// synthesisRetryInterval is the time after which synthesizing a
+	// manifest is tried again for an image where it failed.
+	synthesisRetryInterval = time.Hour
+)
+
+// synthesisChecks records the images that have been checked for a
+// synthesized manifest, or are waiting to be, so that their layers are
+// reproduced only once.
+type synthesisChecks struct {
+	lock sync.Mutex
+	// checked holds the time at which synthesis failed for each image, or
+	// the zero time if it succeeded, was not needed or is in progress.
+	checked map[string]time.Time
+}
+
+func newSynthesisChecks() *synthesisChecks {
+	return &synthesisChecks{checked: map[string]time.Time{}}
+}
+
+// start records that an image is to be checked, and returns false if it
+// already has been or is waiting to be.
+func (sc *synthesisChecks) start(imageID string) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	failed, ok := sc.checked[imageID]
+	if ok && (failed.IsZero() || time.Since(failed) < synthesisRetryInterval) {
+		return false
+	}
+	sc.checked[imageID] = time.Time{}
+	return true
+}
+
+// fail records that synthesis failed for an image.
+func (sc *synthesisChecks) fail(imageID string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.checked[imageID] = time.Now()
+}
+
+// forget discards the record of an image, so that it is checked again.
+func (sc *synthesisChecks) forget(imageID string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	delete(sc.checked, imageID)
+}
+
+// prune forgets the images for which exists returns false.
+func (sc *synthesisChecks) prune(exists func(imageID string) bool) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for id := range sc.checked {
+		if !exists(id) {
+			delete(sc.checked, id)
+		}
+	}
+}
+
+// synthesizedManifest returns the digest of the manifest synthesized for an
+// image whose original layer blobs cannot all be reproduced. It returns an
+// empty digest if synthesis is not enabled, the image does not need it or it
+// has not been done yet. Images that have not been checked are queued to be
+// checked in the background, since reproducing their layers takes far longer
+// than a lookup should. Images in read-only stores are never checked, since
+// the manifest could not be stored with them.
+func (cs *containerStorage) synthesizedManifest(ctx context.Context, image *storage.Image) digest.Digest {
+	if !cs.synthesize {
+		return ""
+	}
+	if d, ok := image.BigDataDigests[synthesizedManifestKey]; ok {
+		return d
+	}
+	if image.ReadOnly || !cs.synthesized.start(image.ID) {
+		return ""
+	}
+	select {
+	case cs.synthesisQueue <- image.ID:
+	default:
+		// Check it on a later lookup instead
+		cs.synthesized.forget(image.ID)
+	}
+	return ""
+}
+
+// synthesizeQueued checks the images queued by synthesizedManifest, one at a
+// time, until the driver is closed.
+func (cs *containerStorage) synthesizeQueued() {
+	defer cs.watching.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-cs.done
+		cancel()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-cs.synthesisQueue:
+			cs.synthesizeImage(ctx, id)
+		}
+	}
+}
+
+// synthesizeImage synthesizes a manifest for an image if it needs one.
+func (cs *containerStorage) synthesizeImage(ctx context.Context, imageID string) {
+	logger := dcontext.GetLoggerWithField(ctx, "image", imageID)
+	image, err := cs.store.Image(imageID)
+	if err != nil {
+		// The image has been removed
+		cs.synthesized.forget(imageID)
+		return
+	}
+	d, err := cs.synthesizeManifest(ctx, image)
+	if err != nil {
+		logger.Errorf("containerstorage: cannot synthesize manifest: %v", err)
+		cs.synthesized.fail(imageID)
+		return
+	}
+	if d != "" {
+		logger.Infof("containerstorage: synthesized manifest %s", d)
+	}
+}
+
+// synthesizeManifest tries to reproduce each of an image's layer blobs and,
+// if any of them cannot be reproduced, stores an OCI image manifest that
+// refers to the uncompressed diffs of those layers instead. Docker media
+// types of the original manifest are replaced by their OCI equivalents.
+func (cs *containerStorage) synthesizeManifest(ctx context.Context, image *storage.Image) (digest.Digest, error) {
+	b, err := cs.store.ImageBigData(image.ID, storage.ImageDigestBigDataKey)
+	if err != nil {
+		return "", err
+	}
+	var original struct {
+		Config v1.Descriptor `json:"config"`
+	}
+	if err := json.Unmarshal(b, &original); err != nil {
+		return "", fmt.Errorf("cannot parse manifest of image %s: %w", image.ID, err)
+	}
+	manifestLayers, err := cs.manifestLayers(image)
+	if err != nil {
+		return "", err
+	}
+
+	layers := make([]v1.Descriptor, 0, len(manifestLayers))
+	replaced := false
+	for _, ml := range manifestLayers {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		_, size, err := cs.getBlob(ctx, ml.digest.Encoded())
+		if err == nil {
+			layers = append(layers, v1.Descriptor{
+				MediaType: ociMediaType(ml.mediaType),
+				Digest:    ml.digest,
+				Size:      size,
+			})
+			continue
+		}
+		if !errors.As(err, &ErrUnreproducibleBlob{}) {
+			return "", err
+		}
+		_, size, err = cs.getBlob(ctx, ml.diffID.Encoded())
+		if err != nil {
+			return "", err
+		}
+		layers = append(layers, v1.Descriptor{
+			MediaType: v1.MediaTypeImageLayer,
+			Digest:    ml.diffID,
+			Size:      size,
+		})
+		replaced = true
+	}
+	if !replaced {
+		return "", nil
+	}
+
+	// Docker image configs are compatible with the OCI format, so the
+	// original config is referenced unchanged, with the OCI media type.
+	configType := ociMediaType(original.Config.MediaType)
+	if configType == "" {
+		configType = v1.MediaTypeImageConfig
+	}
+	manifest, err := json.Marshal(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: configType,
+			Digest:    original.Config.Digest,
+			Size:      original.Config.Size,
+		},
+		Layers: layers,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := cs.store.SetImageBigData(image.ID, synthesizedManifestKey, manifest, manifestDigestFunc); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(manifest), nil
+}
@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSynthesizingTestStorage returns a test store that synthesizes
+// manifests.
+func newSynthesizingTestStorage(t *testing.T) *containerStorage {
+	t.Helper()
+	return newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions":       []interface{}{},
+		"synthesizemanifests": true,
+	})
+}
+
+// waitForTag returns the digest of a tag once it no longer refers to the
+// given manifest.
+func waitForTag(t *testing.T, cs *containerStorage, repo, tag string, original digest.Digest) digest.Digest {
+	t.Helper()
+	var d digest.Digest
+	require.Eventually(t, func() bool {
+		tags, err := cs.listRepoTags(context.Background(), repo)
+		require.NoError(t, err)
+		d = digest.NewDigestFromEncoded(digest.Canonical, tags[tag])
+		return d != original
+	}, 10*time.Second, 10*time.Millisecond)
+	return d
+}
+
+func TestSynthesizedManifest(t *testing.T) {
+	cs := newSynthesizingTestStorage(t)
+	layerTar := testLayerTar(t, "hello", "Hello, World!")
+	goodLayer := gzipTestLayer(t, testLayerTar(t, "goodbye", "Goodbye!"), gzip.DefaultCompression)
+	badLayer := gzipTestLayer(t, layerTar, gzip.NoCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, goodLayer, badLayer)
+
+	// The tag refers to the original manifest until the new one is ready
+	synthesized := waitForTag(t, cs, "localhost/foo", "latest", img.manifest)
+
+	// Both the original and the synthesized manifests are revisions
+	revisions, err := cs.listRepoRevisions(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{img.manifest.Encoded(), synthesized.Encoded()}, revisions)
+
+	var manifest v1.Manifest
+	require.NoError(t, json.Unmarshal(readTestBlob(t, cs, synthesized), &manifest))
+	assert.Equal(t, v1.MediaTypeImageManifest, manifest.MediaType)
+	assert.Equal(t, img.config, manifest.Config.Digest)
+	require.Len(t, manifest.Layers, 2)
+	assert.Equal(t, img.layers[0], manifest.Layers[0].Digest)
+	assert.Equal(t, v1.MediaTypeImageLayer, manifest.Layers[1].MediaType)
+	assert.Equal(t, img.diffIDs[1], manifest.Layers[1].Digest)
+	assert.Equal(t, int64(len(layerTar)), manifest.Layers[1].Size)
+	assert.Equal(t, layerTar, readTestBlob(t, cs, manifest.Layers[1].Digest))
+
+	// The registry resolves the tag to the synthesized manifest
+	ctx := context.Background()
+	repo := newTestRepository(t, &driver{store: cs}, "localhost/foo")
+	desc, err := repo.Tags(ctx).Get(ctx, "latest")
+	require.NoError(t, err)
+	assert.Equal(t, synthesized, desc.Digest)
+	ms, err := repo.Manifests(ctx)
+	require.NoError(t, err)
+	_, err = ms.Get(ctx, synthesized)
+	assert.NoError(t, err)
+}
+
+func TestSynthesizedManifestFromDockerSchema2(t *testing.T) {
+	cs := newSynthesizingTestStorage(t)
+	goodLayer := gzipTestLayer(t, testLayerTar(t, "goodbye", "Goodbye!"), gzip.DefaultCompression)
+	badLayer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.NoCompression)
+	img := addTestImageWithMediaTypes(t, cs, dockerTestMediaTypes, []string{"localhost/foo:latest"}, goodLayer, badLayer)
+
+	synthesized := waitForTag(t, cs, "localhost/foo", "latest", img.manifest)
+
+	// Only OCI media types are used in the OCI manifest
+	var manifest v1.Manifest
+	require.NoError(t, json.Unmarshal(readTestBlob(t, cs, synthesized), &manifest))
+	assert.Equal(t, v1.MediaTypeImageManifest, manifest.MediaType)
+	assert.Equal(t, v1.MediaTypeImageConfig, manifest.Config.MediaType)
+	assert.Equal(t, img.config, manifest.Config.Digest)
+	require.Len(t, manifest.Layers, 2)
+	assert.Equal(t, v1.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+	assert.Equal(t, img.layers[0], manifest.Layers[0].Digest)
+	assert.Equal(t, v1.MediaTypeImageLayer, manifest.Layers[1].MediaType)
+	assert.Equal(t, img.diffIDs[1], manifest.Layers[1].Digest)
+}
+
+func TestSynthesizedManifestNotNeeded(t *testing.T) {
+	cs := newSynthesizingTestStorage(t)
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.DefaultCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	tags, err := cs.listRepoTags(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, img.manifest.Encoded(), tags["latest"])
+	// The image is checked only once
+	assert.False(t, cs.synthesized.start(img.id))
+}
+
+func TestSynthesizedManifestFailure(t *testing.T) {
+	cs := newSynthesizingTestStorage(t)
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.NoCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+	// Without the original manifest no new one can be made
+	require.NoError(t, cs.store.SetImageBigData(img.id, storage.ImageDigestBigDataKey, []byte("{"), manifestDigestFunc))
+
+	cs.synthesizeImage(context.Background(), img.id)
+	assert.False(t, cs.synthesized.start(img.id), "failure should be recorded")
+	cs.synthesized.checked[img.id] = time.Now().Add(-synthesisRetryInterval)
+	assert.True(t, cs.synthesized.start(img.id), "failure should be retried later")
+}
+
+func TestSynthesizedManifestReadOnly(t *testing.T) {
+	shared := newTestStorage(t)
+	img := addTestImage(t, shared, []string{"localhost/foo:latest"},
+		gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.NoCompression))
+	link := filepath.Join(t.TempDir(), "shared")
+	require.NoError(t, os.Symlink(shared.store.GraphRoot(), link))
+	cs := newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions":         []interface{}{},
+		"additionalimagestores": []interface{}{link},
+		"synthesizemanifests":   true,
+	})
+
+	tags, err := cs.listRepoTags(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": img.manifest.Encoded()}, tags)
+	// The image is not queued, since its store cannot be written
+	assert.True(t, cs.synthesized.start(img.id))
+}
+
+func TestSynthesizedManifestDisabled(t *testing.T) {
+	cs := newTestStorage(t)
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.NoCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+
+	tags, err := cs.listRepoTags(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, img.manifest.Encoded(), tags["latest"])
+	revisions, err := cs.listRepoRevisions(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{img.manifest.Encoded()}, revisions)
+}
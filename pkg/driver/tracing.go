@@ -0,0 +1,62 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the driver's operations as OpenTelemetry spans. Until the
+// program embedding the driver installs a tracer provider, nothing is
+// recorded.
+var tracer = otel.Tracer("github.com/zaneb/distribution-containers-storage/pkg/driver")
+
+// Attributes of the driver's spans.
+const (
+	attrPath        = attribute.Key("containerstorage.path")
+	attrDestination = attribute.Key("containerstorage.destination")
+	attrRepository  = attribute.Key("containerstorage.repository")
+	attrDigest      = attribute.Key("containerstorage.digest")
+	attrLayer       = attribute.Key("containerstorage.layer")
+	attrStrategy    = attribute.Key("containerstorage.strategy")
+	attrStore       = attribute.Key("containerstorage.store")
+)
+
+// startSpan starts a span for an operation, as a child of any span in ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "containerstorage."+name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, recording the error that the operation failed with,
+// if any. It is deferred with a pointer to the operation's error result. A
+// path or blob that is not found is an expected outcome, not an error.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil && !errors.As(*err, &storagedriver.PathNotFoundError{}) && !errors.Is(*err, errNotFound) {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// startSpan starts a span for an operation on the container store, which is
+// identified by its graph root when several are served together.
+func (cs *containerStorage) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return startSpan(ctx, name, append(attrs, attrStore.String(cs.store.GraphRoot()))...)
+}
+
+// spanReadCloser ends a span when the reader is closed.
+type spanReadCloser struct {
+	io.ReadCloser
+	span trace.Span
+}
+
+func (r spanReadCloser) Close() error {
+	defer r.span.End()
+	return r.ReadCloser.Close()
+}
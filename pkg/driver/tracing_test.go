@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	testExporter     = tracetest.NewInMemoryExporter()
+	testProvider     *sdktrace.TracerProvider
+	testProviderOnce sync.Once
+)
+
+// testTrace starts a span under which the driver's spans are recorded, and
+// returns a function that ends it and returns the spans in its trace by name.
+func testTrace(t *testing.T) (context.Context, func() map[string]tracetest.SpanStub) {
+	t.Helper()
+	// The global tracer provider can only be installed once
+	testProviderOnce.Do(func() {
+		testProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(testExporter))
+		otel.SetTracerProvider(testProvider)
+	})
+	ctx, root := testProvider.Tracer("test").Start(context.Background(), t.Name())
+	return ctx, func() map[string]tracetest.SpanStub {
+		root.End()
+		spans := map[string]tracetest.SpanStub{}
+		for _, s := range testExporter.GetSpans() {
+			if s.SpanContext.TraceID() == root.SpanContext().TraceID() {
+				spans[s.Name] = s
+			}
+		}
+		return spans
+	}
+}
+
+func assertSpanParent(t *testing.T, spans map[string]tracetest.SpanStub, child, parent string) {
+	t.Helper()
+	c, ok := spans[child]
+	if !assert.True(t, ok, "no span %s", child) {
+		return
+	}
+	p, ok := spans[parent]
+	if !assert.True(t, ok, "no span %s", parent) {
+		return
+	}
+	assert.Equal(t, p.SpanContext.SpanID(), c.Parent.SpanID(), "parent of %s", child)
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, a := range span.Attributes {
+		if a.Key == key {
+			return a.Value.AsString()
+		}
+	}
+	return ""
+}
+
+func TestTracing(t *testing.T) {
+	cs := newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions": []interface{}{},
+		"compressors":   []interface{}{"gzip"},
+		"cachedir":      t.TempDir(),
+	})
+	d := &driver{store: cs}
+	layer := gzipTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), gzip.DefaultCompression)
+	img := addTestImage(t, cs, []string{"localhost/foo:latest"}, layer)
+	path := "/docker/registry/v2/blobs/sha256/" + img.layers[0].Encoded()[:2] + "/" + img.layers[0].Encoded() + "/data"
+
+	ctx, end := testTrace(t)
+	r, err := d.Reader(ctx, path, 0)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	spans := end()
+
+	assertSpanParent(t, spans, "containerstorage.Reader", t.Name())
+	assertSpanParent(t, spans, "containerstorage.getBlob", "containerstorage.Reader")
+	assertSpanParent(t, spans, "containerstorage.reproduceBlob", "containerstorage.getBlob")
+	assertSpanParent(t, spans, "containerstorage.compress", "containerstorage.reproduceBlob")
+	assertSpanParent(t, spans, "containerstorage.diff", "containerstorage.getBlob")
+	assert.Equal(t, path, spanAttribute(spans["containerstorage.Reader"], attrPath))
+	assert.Equal(t, img.layers[0].Encoded(), spanAttribute(spans["containerstorage.getBlob"], attrDigest))
+	assert.Equal(t, "gzip", spanAttribute(spans["containerstorage.compress"], attrStrategy))
+	assert.NotEmpty(t, spanAttribute(spans["containerstorage.diff"], attrLayer))
+
+	// Listing a repository's tags goes through the store
+	ctx, end = testTrace(t)
+	_, err = d.List(ctx, "/docker/registry/v2/repositories/localhost/foo/_manifests/tags")
+	require.NoError(t, err)
+	spans = end()
+	assertSpanParent(t, spans, "containerstorage.listRepoTags", "containerstorage.List")
+
+	// A missing path is not an error
+	missing := digest.FromString("missing")
+	ctx, end = testTrace(t)
+	_, err = d.Stat(ctx, "/docker/registry/v2/repositories/localhost/foo/_layers/sha256/"+missing.Encoded()+"/link")
+	require.Error(t, err)
+	spans = end()
+	if span, ok := spans["containerstorage.Stat"]; assert.True(t, ok) {
+		assert.Equal(t, codes.Unset, span.Status.Code)
+	}
+	ctx, end = testTrace(t)
+	_, _, err = cs.getBlob(ctx, missing.Encoded())
+	require.ErrorIs(t, err, errNotFound)
+	spans = end()
+	if span, ok := spans["containerstorage.getBlob"]; assert.True(t, ok) {
+		assert.Equal(t, codes.Unset, span.Status.Code)
+	}
+
+	// Errors are recorded
+	ctx, end = testTrace(t)
+	err = d.PutContent(ctx, "/docker/registry/v2/repositories/localhost/foo/_manifests/tags/latest/current/link", []byte(missing.String()))
+	require.Error(t, err)
+	spans = end()
+	if span, ok := spans["containerstorage.PutContent"]; assert.True(t, ok) {
+		assert.Equal(t, codes.Error, span.Status.Code)
+	}
+	if span, ok := spans["containerstorage.putTag"]; assert.True(t, ok) {
+		assert.Equal(t, codes.Error, span.Status.Code)
+	}
+}
@@ -0,0 +1,497 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+// unionStore presents several container stores as a single registry. The
+// repositories of a store with a prefix are named with the prefix followed
+// by a slash; those of stores without a prefix are merged. Blobs with the
+// same digest are identical wherever they are found, so each is listed once
+// and served from the first store that can provide it.
+//
+// Content pushed to a repository goes to the store with the repository's
+// prefix or, if there is none, to the first store without a prefix. A
+// repository in a store without a prefix whose name begins with another
+// store's prefix cannot be reached, so it is left out of the catalog.
+type unionStore struct {
+	members []*unionMember
+	// shadowedMu guards shadowed, the repositories last left out of the
+	// catalog, so that each is reported only when it is first found.
+	shadowedMu sync.Mutex
+	shadowed   map[string]bool
+	// tempDirs holds the temporary directories created for the union,
+	// which are removed when it is closed.
+	tempDirs []string
+}
+
+type unionMember struct {
+	prefix string
+	cs     *containerStorage
+}
+
+// routedMember is a store in which a repository may be found, along with
+// the repository's name in that store.
+type routedMember struct {
+	cs   *containerStorage
+	repo string
+}
+
+// newStore opens the container stores selected by params.
+func newStore(params *driverParameters) (store, error) {
+	if len(params.stores) == 0 {
+		return newContainerStorage(params)
+	}
+	return newUnionStore(params)
+}
+
+func newUnionStore(params *driverParameters) (*unionStore, error) {
+	u := &unionStore{}
+	uploadDir := params.uploadDir
+	if uploadDir == "" {
+		var err error
+		uploadDir, err = os.MkdirTemp("", "containerstorage-uploads-")
+		if err != nil {
+			return nil, err
+		}
+		u.tempDirs = append(u.tempDirs, uploadDir)
+	}
+	// Staged blobs are shared, so that a manifest pushed to one store may
+	// refer to blobs that the registry wrote without regard to repository.
+	staged, err := newBlobCache(filepath.Join(uploadDir, "blobs"), 0, nil)
+	if err != nil {
+		u.close()
+		return nil, err
+	}
+	// The limit on concurrent compression applies to the host as a whole
+	shared := &sharedCaches{
+		union:        u,
+		staged:       staged,
+		compressions: make(chan struct{}, params.maxCompressions),
+	}
+	for i, sp := range params.stores {
+		memberParams := *sp
+		memberParams.uploadDir = filepath.Join(uploadDir, "stores", strconv.Itoa(i))
+		if sp.cacheDir != "" {
+			memberParams.cacheDir = filepath.Join(sp.cacheDir, strconv.Itoa(i))
+		} else if shared.spool == nil {
+			// Stores without a cache share a single spool, so
+			// that its size limits the temporary space used by
+			// the registry as a whole.
+			shared.spool, err = newSpool(sp.cacheSize, u.hasLayer)
+			if err != nil {
+				u.close()
+				return nil, err
+			}
+			u.tempDirs = append(u.tempDirs, shared.spool.dir)
+		}
+		cs, err := openContainerStorage(&memberParams, shared)
+		if err != nil {
+			u.close()
+			return nil, fmt.Errorf("cannot open container store %d: %w", i, err)
+		}
+		u.members = append(u.members, &unionMember{prefix: sp.prefix, cs: cs})
+	}
+	// Background work may consult the other stores, so it starts only
+	// once they have all been opened.
+	for i, m := range u.members {
+		m.cs.start(params.stores[i])
+	}
+	return u, nil
+}
+
+// close closes each of the stores and removes the temporary directories
+// shared by them.
+func (u *unionStore) close() error {
+	var errs []error
+	for _, m := range u.members {
+		if err := m.cs.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, dir := range u.tempDirs {
+		os.RemoveAll(dir)
+	}
+	return errors.Join(errs...)
+}
+
+// hasLayer returns whether any of the stores has a layer with the given
+// compressed or uncompressed digest.
+func (u *unionStore) hasLayer(d digest.Digest) bool {
+	for _, m := range u.members {
+		if m.cs.hasLayer(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// originalBlob returns a layer blob that any of the stores keeps in its
+// original compressed form.
+func (u *unionStore) originalBlob(d digest.Digest) (blobFunc, bool) {
+	for _, m := range u.members {
+		if getBlobReader, ok := m.cs.keptBlob(d); ok {
+			return getBlobReader, true
+		}
+	}
+	return nil, false
+}
+
+// prefixed returns the store with a prefix to which a repository belongs,
+// and the repository's name in that store.
+func (u *unionStore) prefixed(repo string) (*unionMember, string, bool) {
+	for _, m := range u.members {
+		if m.prefix == "" {
+			continue
+		}
+		if inner, ok := strings.CutPrefix(repo, m.prefix+"/"); ok {
+			return m, inner, true
+		}
+	}
+	return nil, "", false
+}
+
+// route returns the stores in which a repository may be found. A repository
+// whose name begins with a store's prefix belongs to that store alone.
+func (u *unionStore) route(repo string) []routedMember {
+	if m, inner, ok := u.prefixed(repo); ok {
+		return []routedMember{{m.cs, inner}}
+	}
+	routed := []routedMember{}
+	for _, m := range u.members {
+		if m.prefix == "" {
+			routed = append(routed, routedMember{m.cs, repo})
+		}
+	}
+	return routed
+}
+
+// pushTarget returns the store to which content pushed to a repository is
+// written.
+func (u *unionStore) pushTarget(repo string) (routedMember, error) {
+	routed := u.route(repo)
+	if len(routed) == 0 {
+		return routedMember{}, fmt.Errorf("repository %s does not belong to any container store", repo)
+	}
+	return routed[0], nil
+}
+
+func (u *unionStore) listRepos(ctx context.Context) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "union.listRepos")
+	defer endSpan(span, &err)
+	repos := newStringSet()
+	shadowed := map[string]bool{}
+	for _, m := range u.members {
+		memberRepos, err := m.cs.listRepos(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range memberRepos {
+			if m.prefix != "" {
+				r = m.prefix + "/" + r
+			} else if _, _, ok := u.prefixed(r); ok {
+				shadowed[r] = true
+				continue
+			}
+			repos.add(r)
+		}
+	}
+	u.reportShadowed(ctx, shadowed)
+	return repos.list(), nil
+}
+
+// reportShadowed logs the repositories left out of the catalog because
+// their names begin with another store's prefix, if they were not already
+// left out the last time it was listed.
+func (u *unionStore) reportShadowed(ctx context.Context, shadowed map[string]bool) {
+	u.shadowedMu.Lock()
+	defer u.shadowedMu.Unlock()
+	for repo := range shadowed {
+		if u.shadowed[repo] {
+			continue
+		}
+		m, _, _ := u.prefixed(repo)
+		dcontext.GetLoggerWithField(ctx, "repository", repo).Warnf("containerstorage: repository name begins with the prefix %q of another container store; leaving it out of the catalog", m.prefix)
+	}
+	u.shadowed = shadowed
+}
+
+// listRouted merges the lists returned for a repository by each store in
+// which it may be found.
+func (u *unionStore) listRouted(ctx context.Context, repo string, list func(cs *containerStorage, ctx context.Context, repo string) ([]string, error)) ([]string, error) {
+	items := newStringSet()
+	for _, r := range u.route(repo) {
+		memberItems, err := list(r.cs, ctx, r.repo)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range memberItems {
+			items.add(item)
+		}
+	}
+	return items.list(), nil
+}
+
+func (u *unionStore) listRepoRevisions(ctx context.Context, repo string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "union.listRepoRevisions", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	return u.listRouted(ctx, repo, (*containerStorage).listRepoRevisions)
+}
+
+func (u *unionStore) listRepoLayers(ctx context.Context, repo string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "union.listRepoLayers", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	return u.listRouted(ctx, repo, (*containerStorage).listRepoLayers)
+}
+
+func (u *unionStore) listRepoTags(ctx context.Context, repo string) (_ map[string]string, err error) {
+	ctx, span := startSpan(ctx, "union.listRepoTags", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	tags := map[string]string{}
+	for _, r := range u.route(repo) {
+		memberTags, err := r.cs.listRepoTags(ctx, r.repo)
+		if err != nil {
+			return nil, err
+		}
+		for tag, sha := range memberTags {
+			// Earlier stores take precedence
+			if _, ok := tags[tag]; !ok {
+				tags[tag] = sha
+			}
+		}
+	}
+	return tags, nil
+}
+
+func (u *unionStore) listBlobs(ctx context.Context, prefix string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "union.listBlobs")
+	defer endSpan(span, &err)
+	blobs := newStringSet()
+	for _, m := range u.members {
+		memberBlobs, err := m.cs.listBlobs(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, sha := range memberBlobs {
+			blobs.add(sha)
+		}
+	}
+	return blobs.list(), nil
+}
+
+func (u *unionStore) getBlob(ctx context.Context, sha string) (_ blobFunc, _ int64, err error) {
+	ctx, span := startSpan(ctx, "union.getBlob", attrDigest.String(sha))
+	defer endSpan(span, &err)
+	var firstErr error
+	for _, m := range u.members {
+		getBlobReader, size, err := m.cs.getBlob(ctx, sha)
+		if err == nil {
+			return getBlobReader, size, nil
+		}
+		if firstErr == nil && !errors.Is(err, errNotFound) {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return nil, 0, fmt.Errorf("blob %s %w", sha, errNotFound)
+}
+
+func (u *unionStore) repoModTime(ctx context.Context, repo string) (_ time.Time, err error) {
+	ctx, span := startSpan(ctx, "union.repoModTime", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	routed := u.route(repo)
+	if repo == "" {
+		routed = make([]routedMember, 0, len(u.members))
+		for _, m := range u.members {
+			routed = append(routed, routedMember{cs: m.cs})
+		}
+	}
+	var modTime time.Time
+	for _, r := range routed {
+		t, err := r.cs.repoModTime(ctx, r.repo)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t.After(modTime) {
+			modTime = t
+		}
+	}
+	return modTime, nil
+}
+
+func (u *unionStore) blobModTime(ctx context.Context, sha string) (_ time.Time, err error) {
+	ctx, span := startSpan(ctx, "union.blobModTime", attrDigest.String(sha))
+	defer endSpan(span, &err)
+	var modTime time.Time
+	for _, m := range u.members {
+		t, err := m.cs.blobModTime(ctx, sha)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !t.IsZero() && (modTime.IsZero() || t.Before(modTime)) {
+			modTime = t
+		}
+	}
+	return modTime, nil
+}
+
+func (u *unionStore) uploadPath(repo, subPath string) (string, error) {
+	target, err := u.pushTarget(repo)
+	if err != nil {
+		return "", err
+	}
+	return target.cs.uploadPath(target.repo, subPath)
+}
+
+func (u *unionStore) putBlob(ctx context.Context, sha string, content io.Reader) (err error) {
+	ctx, span := startSpan(ctx, "union.putBlob", attrDigest.String(sha))
+	defer endSpan(span, &err)
+	// The staged blobs are shared by all of the stores
+	return u.members[0].cs.putBlob(ctx, sha, content)
+}
+
+func (u *unionStore) moveUpload(ctx context.Context, repo, subPath, sha string) (err error) {
+	ctx, span := startSpan(ctx, "union.moveUpload", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	target, err := u.pushTarget(repo)
+	if err != nil {
+		return err
+	}
+	return target.cs.moveUpload(ctx, target.repo, subPath, sha)
+}
+
+func (u *unionStore) linkLayer(ctx context.Context, repo, sha string) (err error) {
+	ctx, span := startSpan(ctx, "union.linkLayer", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	target, err := u.pushTarget(repo)
+	if err != nil {
+		return err
+	}
+	return target.cs.linkLayer(ctx, target.repo, sha)
+}
+
+func (u *unionStore) putManifest(ctx context.Context, repo, sha string) (err error) {
+	ctx, span := startSpan(ctx, "union.putManifest", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	target, err := u.pushTarget(repo)
+	if err != nil {
+		return err
+	}
+	return target.cs.putManifest(ctx, target.repo, sha)
+}
+
+func (u *unionStore) putTag(ctx context.Context, repo, tag, sha string) (err error) {
+	ctx, span := startSpan(ctx, "union.putTag", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	target, err := u.pushTarget(repo)
+	if err != nil {
+		return err
+	}
+	return target.cs.putTag(ctx, target.repo, tag, sha)
+}
+
+// deleteRouted deletes from each store in which a repository may be found.
+func (u *unionStore) deleteRouted(repo string, del func(cs *containerStorage, repo string) error) error {
+	return deleteAll("repository "+repo, u.route(repo), del)
+}
+
+// deleteAll deletes from each of the given stores, and succeeds if the
+// deletion succeeds in any of them.
+func deleteAll(what string, routed []routedMember, del func(cs *containerStorage, repo string) error) error {
+	var firstErr error
+	deleted := false
+	for _, r := range routed {
+		err := del(r.cs, r.repo)
+		if err == nil {
+			deleted = true
+		} else if firstErr == nil || errors.Is(firstErr, errNotFound) {
+			firstErr = err
+		}
+	}
+	if deleted {
+		return nil
+	}
+	if firstErr == nil {
+		return fmt.Errorf("%s %w", what, errNotFound)
+	}
+	return firstErr
+}
+
+func (u *unionStore) deleteTag(ctx context.Context, repo, tag string) (err error) {
+	ctx, span := startSpan(ctx, "union.deleteTag", attrRepository.String(repo))
+	defer endSpan(span, &err)
+	return u.deleteRouted(repo, func(cs *containerStorage, repo string) error {
+		return cs.deleteTag(ctx, repo, tag)
+	})
+}
+
+func (u *unionStore) deleteManifest(ctx context.Context, repo, sha string) (err error) {
+	ctx, span := startSpan(ctx, "union.deleteManifest", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	return u.deleteRouted(repo, func(cs *containerStorage, repo string) error {
+		return cs.deleteManifest(ctx, repo, sha)
+	})
+}
+
+func (u *unionStore) deleteLayerLink(ctx context.Context, repo, sha string) (err error) {
+	ctx, span := startSpan(ctx, "union.deleteLayerLink", attrRepository.String(repo), attrDigest.String(sha))
+	defer endSpan(span, &err)
+	return u.deleteRouted(repo, func(cs *containerStorage, repo string) error {
+		return cs.deleteLayerLink(ctx, repo, sha)
+	})
+}
+
+func (u *unionStore) deleteBlob(ctx context.Context, sha string) (err error) {
+	ctx, span := startSpan(ctx, "union.deleteBlob", attrDigest.String(sha))
+	defer endSpan(span, &err)
+	// A blob still in use in any store must not appear deleted
+	found := false
+	for _, m := range u.members {
+		err := m.cs.deleteBlob(ctx, sha)
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, errNotFound) {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("blob %s %w", sha, errNotFound)
+	}
+	return nil
+}
+
+// stringSet is an insertion-ordered set of strings.
+type stringSet struct {
+	seen  map[string]struct{}
+	items []string
+}
+
+func newStringSet() *stringSet {
+	return &stringSet{seen: map[string]struct{}{}}
+}
+
+func (s *stringSet) add(item string) {
+	if _, ok := s.seen[item]; ok {
+		return
+	}
+	s.seen[item] = struct{}{}
+	s.items = append(s.items, item)
+}
+
+func (s *stringSet) list() []string {
+	return s.items
+}
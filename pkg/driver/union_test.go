@@ -0,0 +1,216 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	registrystorage "github.com/distribution/distribution/v3/registry/storage"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestUnion returns a union of stores using the vfs driver in temporary
+// directories, with the given prefixes.
+func newTestUnion(t *testing.T, prefixes ...string) *unionStore {
+	t.Helper()
+	root := t.TempDir()
+	t.Setenv("TMPDIR", root)
+	stores := []interface{}{}
+	for i, prefix := range prefixes {
+		dir := filepath.Join(root, "store", string(rune('a'+i)))
+		stores = append(stores, map[string]interface{}{
+			"graphroot": dir + "/graph",
+			"runroot":   dir + "/run",
+			"prefix":    prefix,
+		})
+	}
+	params, err := fromParameters(map[string]interface{}{
+		"driver":        "vfs",
+		"driveroptions": []interface{}{},
+		"uploaddir":     root + "/uploads",
+		"stores":        stores,
+	})
+	require.NoError(t, err)
+	s, err := newStore(params)
+	require.NoError(t, err)
+	u := s.(*unionStore)
+	t.Cleanup(func() { u.close() })
+	return u
+}
+
+func TestUnionStores(t *testing.T) {
+	u := newTestUnion(t, "", "rootless")
+	system, rootless := u.members[0].cs, u.members[1].cs
+	// The stores are opened with the union and its limits in place
+	for _, m := range u.members {
+		assert.Same(t, u, m.cs.union)
+	}
+	assert.Equal(t, system.compressions, rootless.compressions)
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	systemImg := addTestImage(t, system, []string{"localhost/foo:latest"}, layer)
+	rootlessImg := addTestImage(t, rootless, []string{"localhost/foo:v1", "localhost/bar:latest"},
+		layer, compressTestLayer(t, testLayerTar(t, "goodbye", "Goodbye, World!"), archive.Gzip))
+
+	repos, err := u.listRepos(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"localhost/foo",
+		"rootless/localhost/foo",
+		"rootless/localhost/bar",
+	}, repos)
+
+	tags, err := u.listRepoTags(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": systemImg.manifest.Encoded()}, tags)
+	tags, err = u.listRepoTags(context.Background(), "rootless/localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"v1": rootlessImg.manifest.Encoded()}, tags)
+	_, err = u.listRepoTags(context.Background(), "rootless/localhost/baz")
+	assert.NoError(t, err)
+
+	// The layer shared by both stores is listed once
+	blobs, err := u.listBlobs(context.Background(), systemImg.layers[0].Encoded())
+	require.NoError(t, err)
+	assert.Equal(t, []string{systemImg.layers[0].Encoded()}, blobs)
+
+	// Blobs are found in whichever store has them
+	for _, d := range append(rootlessImg.layers, rootlessImg.config, systemImg.config) {
+		_, _, err := u.getBlob(context.Background(), d.Encoded())
+		assert.NoError(t, err, d.String())
+	}
+	_, _, err = u.getBlob(context.Background(), digest.FromString("missing").Encoded())
+	assert.ErrorIs(t, err, errNotFound)
+}
+
+func TestUnionPrefixCollision(t *testing.T) {
+	u := newTestUnion(t, "", "localhost")
+	system, prefixed := u.members[0].cs, u.members[1].cs
+	layer := compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip)
+	addTestImage(t, system, []string{"localhost/foo:latest", "docker.io/library/bar:latest"}, layer)
+	addTestImage(t, prefixed, []string{"localhost/baz:latest"}, layer)
+	logger, hook := logtest.NewNullLogger()
+	ctx := dcontext.WithLogger(context.Background(), logrus.NewEntry(logger))
+
+	// localhost/foo in the store without a prefix would be routed to the
+	// prefixed store, so it is left out of the catalog
+	repos, err := u.listRepos(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"docker.io/library/bar",
+		"localhost/localhost/baz",
+	}, repos)
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, "localhost/foo", hook.LastEntry().Data["repository"])
+
+	// It is reported only when first found
+	_, err = u.listRepos(ctx)
+	require.NoError(t, err)
+	assert.Len(t, hook.AllEntries(), 1)
+}
+
+func TestUnionPush(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUnion(t, "", "rootless")
+	system, rootless := u.members[0].cs, u.members[1].cs
+	d := &driver{store: u}
+
+	pushed := pushTestImage(t, newTestRepository(t, d, "rootless/localhost/foo"), "latest", "Hello, World!")
+	image, err := rootless.store.Image(pushed.config.Digest.Encoded())
+	require.NoError(t, err)
+	assert.Contains(t, image.Names, "localhost/foo:latest")
+	_, err = system.store.Image(pushed.config.Digest.Encoded())
+	assert.Error(t, err)
+
+	// A blob already in one store can be mounted into a repository in
+	// another, rather than being pushed again.
+	repo := newTestRepository(t, d, "localhost/foo")
+	_, err = repo.Blobs(ctx).Stat(ctx, pushed.layer.Digest)
+	assert.ErrorIs(t, err, distribution.ErrBlobUnknown)
+	source, err := reference.WithName("rootless/localhost/foo")
+	require.NoError(t, err)
+	for _, desc := range []distribution.Descriptor{pushed.layer, pushed.config} {
+		canonical, err := reference.WithDigest(source, desc.Digest)
+		require.NoError(t, err)
+		_, err = repo.Blobs(ctx).Create(ctx, registrystorage.WithMountFrom(canonical))
+		assert.ErrorAs(t, err, &distribution.ErrBlobMounted{})
+	}
+	ms, err := repo.Manifests(ctx)
+	require.NoError(t, err)
+	manifestDigest, err := ms.Put(ctx, pushed.manifest)
+	require.NoError(t, err)
+	assert.Equal(t, pushed.digest, manifestDigest)
+	image, err = system.store.Image(pushed.config.Digest.Encoded())
+	require.NoError(t, err)
+	assert.Contains(t, image.Names, "localhost/foo@"+pushed.digest.String())
+
+	tags, err := u.listRepoTags(context.Background(), "rootless/localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": pushed.digest.Encoded()}, tags)
+}
+
+func TestUnionTempDirs(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("TMPDIR", root)
+	params, err := fromParameters(map[string]interface{}{
+		"driver":        "vfs",
+		"driveroptions": []interface{}{},
+		"stores": []interface{}{
+			map[string]interface{}{"graphroot": root + "/a/graph", "runroot": root + "/a/run"},
+			map[string]interface{}{"graphroot": root + "/b/graph", "runroot": root + "/b/run", "prefix": "b"},
+		},
+	})
+	require.NoError(t, err)
+	s, err := newStore(params)
+	require.NoError(t, err)
+	u := s.(*unionStore)
+
+	// Stores without a cache share one spool
+	assert.Same(t, u.members[0].cs.cache, u.members[1].cs.cache)
+	require.Len(t, u.tempDirs, 2)
+	for _, dir := range u.tempDirs {
+		assert.DirExists(t, dir)
+	}
+
+	assert.NoError(t, u.close())
+	for _, dir := range u.tempDirs {
+		assert.NoDirExists(t, dir)
+	}
+}
+
+func TestAdditionalImageStores(t *testing.T) {
+	shared := newTestStorage(t)
+	img := addTestImage(t, shared, []string{"localhost/foo:latest"},
+		compressTestLayer(t, testLayerTar(t, "hello", "Hello, World!"), archive.Gzip))
+
+	// containers/storage keeps one lock per path in each process, and it
+	// cannot be both read-only and read-write, so refer to the shared store
+	// by another path as a separate process would.
+	link := filepath.Join(t.TempDir(), "shared")
+	require.NoError(t, os.Symlink(shared.store.GraphRoot(), link))
+	cs := newTestStorageWithParams(t, map[string]interface{}{
+		"driveroptions":         []interface{}{},
+		"additionalimagestores": []interface{}{link},
+	})
+
+	tags, err := cs.listRepoTags(context.Background(), "localhost/foo")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": img.manifest.Encoded()}, tags)
+	assert.Equal(t, readTestBlob(t, shared, img.layers[0]), readTestBlob(t, cs, img.layers[0]))
+
+	// Images added to the additional store are noticed
+	added := addTestImage(t, shared, []string{"localhost/bar:latest"},
+		compressTestLayer(t, testLayerTar(t, "goodbye", "Goodbye, World!"), archive.Gzip))
+	tags, err = cs.listRepoTags(context.Background(), "localhost/bar")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"latest": added.manifest.Encoded()}, tags)
+}
@@ -0,0 +1,213 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// upload is a file or directory belonging to a blob upload session, which is
+// kept in the upload directory until the upload is complete.
+type upload struct {
+	filePath
+	repo string
+}
+
+// uploadSubPath returns the path of the file relative to the repository's
+// _uploads directory.
+func (u *upload) uploadSubPath() string {
+	prefix := fmt.Sprintf("repositories/%s/_uploads", u.repo)
+	return strings.TrimPrefix(strings.TrimPrefix(u.subPath, prefix), "/")
+}
+
+// localPath returns the location of the file in the upload directory.
+func (u *upload) localPath() (string, error) {
+	return u.store.uploadPath(u.repo, u.uploadSubPath())
+}
+
+func (u *upload) Reader() (io.ReadCloser, error) {
+	path, err := u.localPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, storagedriver.PathNotFoundError{Path: u.path()}
+	}
+	return f, err
+}
+
+func (u *upload) Stat() (storagedriver.FileInfo, error) {
+	path, err := u.localPath()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, storagedriver.PathNotFoundError{Path: u.path()}
+	} else if err != nil {
+		return nil, err
+	}
+	info := storagedriver.FileInfoFields{
+		Path:    u.path(),
+		IsDir:   fi.IsDir(),
+		ModTime: fi.ModTime(),
+	}
+	if !fi.IsDir() {
+		info.Size = fi.Size()
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: info}, nil
+}
+
+func (u *upload) List() ([]string, error) {
+	path, err := u.localPath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, storagedriver.PathNotFoundError{Path: u.path()}
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return u.children(names...), nil
+}
+
+func (u *upload) put(contents []byte) error {
+	path, err := u.localPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, contents, 0o600)
+}
+
+func (u *upload) writer(append bool) (storagedriver.FileWriter, error) {
+	path, err := u.localPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if append {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	if append {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		size = fi.Size()
+	}
+	return newFileWriter(f, size), nil
+}
+
+func (u *upload) delete() error {
+	path, err := u.localPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return storagedriver.PathNotFoundError{Path: u.path()}
+	}
+	return os.RemoveAll(path)
+}
+
+// fileWriter writes an upload to a file in the upload directory.
+type fileWriter struct {
+	file      *os.File
+	size      int64
+	bw        *bufio.Writer
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func newFileWriter(file *os.File, size int64) *fileWriter {
+	return &fileWriter{
+		file: file,
+		size: size,
+		bw:   bufio.NewWriter(file),
+	}
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, errors.New("already closed")
+	} else if fw.committed {
+		return 0, errors.New("already committed")
+	} else if fw.cancelled {
+		return 0, errors.New("already cancelled")
+	}
+	n, err := fw.bw.Write(p)
+	fw.size += int64(n)
+	return n, err
+}
+
+func (fw *fileWriter) Size() int64 {
+	return fw.size
+}
+
+func (fw *fileWriter) Close() error {
+	if fw.closed {
+		return errors.New("already closed")
+	}
+	if err := fw.bw.Flush(); err != nil {
+		return err
+	}
+	if err := fw.file.Close(); err != nil {
+		return err
+	}
+	fw.closed = true
+	return nil
+}
+
+func (fw *fileWriter) Cancel(ctx context.Context) error {
+	if fw.closed {
+		return errors.New("already closed")
+	}
+	fw.cancelled = true
+	fw.file.Close()
+	return os.Remove(fw.file.Name())
+}
+
+func (fw *fileWriter) Commit() error {
+	if fw.closed {
+		return errors.New("already closed")
+	} else if fw.committed {
+		return errors.New("already committed")
+	} else if fw.cancelled {
+		return errors.New("already cancelled")
+	}
+	if err := fw.bw.Flush(); err != nil {
+		return err
+	}
+	if err := fw.file.Sync(); err != nil {
+		return err
+	}
+	fw.committed = true
+	return nil
+}